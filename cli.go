@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	container "malptainer/containers"
+	"malptainer/utils"
+
+	"golang.org/x/term"
+)
+
+// Exit codes returned by the subcommands
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// errUsage is returned by a subcommand when it was called with bad arguments
+var errUsage = errors.New("invalid usage")
+
+// exitStatus is returned by a subcommand to exit with a given code, like the one of a container
+type exitStatus int
+
+func (e exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"run", "run [flags] [binary [arg...]]", "Launch a container running binary with its arguments (default: /bin/sh)", cmdRun},
+	{"ps", "ps [flags]", "List containers", cmdPs},
+	{"rm", "rm <name> [name...]", "Stop and remove one or more containers", cmdRm},
+	{"exec", "exec [flags] <name> [cmd [arg...]]", "Run a command inside a running container (default: an interactive /bin/sh)", cmdExec},
+	{"inspect", "inspect <name> [name...]", "Print container details as JSON", cmdInspect},
+	{"attach", "attach [flags] <name>", "Attach to the stdio of a container's process, detach with ctrl-p ctrl-q", cmdAttach},
+	{"logs", "logs [flags] <name>", "Print the stdout and stderr output of a container", cmdLogs},
+	{"wait", "wait <name>", "Wait for a container to exit and exit with its exit code", cmdWait},
+	{"pull", "pull <name:tag>", "Pull an image from a registry into the local store", cmdPull},
+	{"images", "images [flags]", "List the images in the local store", cmdImages},
+	{"image", "image <add|import|rm> ...", "Manage images: image add <name:tag> <dir>, image import <path> [name:tag], image rm <image> [image...]", cmdImage},
+}
+
+// runCommand dispatches a subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: malptainer %s\n\n%s\n", cmd.usage, cmd.summary)
+			fs.PrintDefaults()
+		}
+
+		err := cmd.run(fs, args)
+		var status exitStatus
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.Is(err, flag.ErrHelp):
+			return exitOK
+		case errors.Is(err, errUsage):
+			fs.Usage()
+			return exitUsage
+		case errors.As(err, &status):
+			return int(status)
+		default:
+			fmt.Fprintf(os.Stderr, "malptainer %s: %v\n", cmd.name, err)
+			return exitError
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "malptainer: unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+func printUsage(w *os.File) {
+	fmt.Fprintln(w, "Usage: malptainer [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Without a command the interactive menu is started.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// parseFlags parses the flags of a subcommand, mapping parse failures to errUsage
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+func cmdRun(fs *flag.FlagSet, args []string) error {
+	quiet := fs.Bool("q", false, "only print the container name on stdout")
+	memory := fs.String("memory", "", "memory limit, e.g. 512M or max (memory.max)")
+	memorySwap := fs.String("memory-swap", "", "swap limit, e.g. 1G, 0 or max (memory.swap.max)")
+	cpus := fs.Float64("cpus", 0, "number of CPUs the container may use, e.g. 1.5 (cpu.max)")
+	cpuWeight := fs.Uint64("cpu-weight", 0, "relative CPU weight between 1 and 10000 (cpu.weight)")
+	pidsLimit := fs.Int64("pids-limit", 0, "maximum number of processes (pids.max)")
+	cgroupParent := fs.String("cgroup-parent", container.DefaultCgroupParent, "parent cgroup, relative to "+container.CgroupRoot)
+	userNS := fs.Bool("userns", false, "run the container in its own user namespace")
+	var uidMaps, gidMaps idMapFlag
+	fs.Var(&uidMaps, "uidmap", "UID mapping containerID:hostID:size, may be repeated (implies --userns)")
+	fs.Var(&gidMaps, "gidmap", "GID mapping containerID:hostID:size, may be repeated (default: same as --uidmap)")
+	subIDs := fs.String("subids", "", "map the subordinate IDs of this user from /etc/subuid and /etc/subgid (implies --userns)")
+	var capAdd, capDrop listFlag
+	fs.Var(&capAdd, "cap-add", "add a capability to the default set, may be repeated or comma separated (ALL for every capability)")
+	fs.Var(&capDrop, "cap-drop", "drop a capability from the default set, may be repeated or comma separated (ALL for every capability)")
+	seccomp := fs.String("seccomp", container.SeccompDefault, "seccomp profile: default, unconfined or a Docker format JSON file")
+	copyInterpreter := fs.Bool("copy-interpreter", false, "copy the interpreter of a script, and its libraries, from the host when the root filesystem lacks it")
+	image := fs.String("image", "", "image to create the container from (default: ./root_fs)")
+	network := fs.String("network", "", "network mode: bridge, none, host or container:<name> (default bridge, none when rootless)")
+	var publish listFlag
+	fs.Var(&publish, "p", "publish a container port on the host as hostPort:containerPort[/tcp|udp], may be repeated or comma separated")
+	var env, envFiles repeatedFlag
+	fs.Var(&env, "e", "set an environment variable as NAME=value, or NAME to pass the host's value, may be repeated")
+	fs.Var(&envFiles, "env-file", "read environment variables from a file of NAME=value lines, may be repeated")
+	workdir := fs.String("w", "", "working directory of the binary inside the container (default: the image's, or /)")
+	user := fs.String("u", "", "user[:group] to run the binary as, by name or ID (default: the image's, or root)")
+	tty := fs.Bool("t", false, "run the binary on a pseudo-terminal and attach to it")
+	interactive := fs.Bool("i", false, "forward the input to the container, with -t")
+	// The flag package doesn't combine single letter flags
+	both := fs.Bool("it", false, "shorthand for -i -t")
+	detachKeys := fs.String("detach-keys", container.DefaultDetachKeys, "key sequence that detaches from the container, with -it")
+	initProcess := fs.Bool("init", false, "run a minimal init as PID 1 that forwards signals to the binary and reaps zombies")
+	logMaxSize := fs.String("log-max-size", "", "size a log file may reach before it is rotated, e.g. 10M (default 10M)")
+	logMaxFiles := fs.Int("log-max-files", 0, fmt.Sprintf("number of log files kept, the current one included (default %d)", container.DefaultLogMaxFiles))
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	opts := container.LaunchOptions{
+		BinaryPath:   "/bin/sh",
+		CgroupParent: *cgroupParent,
+		CapAdd:       capAdd,
+		CapDrop:      capDrop,
+		Seccomp:      *seccomp,
+		Network:      *network,
+		Image:        *image,
+		WorkingDir:   *workdir,
+		User:         *user,
+		Init:         *initProcess,
+
+		CopyInterpreter: *copyInterpreter,
+	}
+	if fs.NArg() > 0 {
+		opts.BinaryPath = fs.Arg(0)
+		opts.Args = fs.Args()[1:]
+	}
+
+	var err error
+	if *both {
+		*interactive, *tty = true, true
+	}
+	if *interactive && !*tty {
+		return fmt.Errorf("-i needs -t, the input is forwarded through the container's terminal")
+	}
+	opts.TTY = *tty
+	attach := container.AttachOptions{Input: *interactive}
+	if attach.DetachKeys, err = container.ParseDetachKeys(*detachKeys); err != nil {
+		return fmt.Errorf("--detach-keys: %w", err)
+	}
+
+	// Files first, so -e overrides them
+	for _, file := range envFiles {
+		entries, err := container.ParseEnvFile(file)
+		if err != nil {
+			return fmt.Errorf("--env-file: %w", err)
+		}
+		opts.Env = append(opts.Env, entries...)
+	}
+	opts.Env = append(opts.Env, env...)
+
+	for _, value := range publish {
+		mapping, err := container.ParsePortMapping(value)
+		if err != nil {
+			return fmt.Errorf("-p: %w", err)
+		}
+		opts.Ports = append(opts.Ports, mapping)
+	}
+
+	if *logMaxSize != "" {
+		if opts.Log.MaxSize, err = utils.ParseByteSize(*logMaxSize); err != nil {
+			return fmt.Errorf("--log-max-size: %w", err)
+		}
+		if opts.Log.MaxSize == 0 {
+			return fmt.Errorf("--log-max-size must be positive")
+		}
+	}
+	opts.Log.MaxFiles = *logMaxFiles
+
+	if opts.Resources.MemoryMax, err = parseMemoryLimit(*memory); err != nil {
+		return fmt.Errorf("--memory: %w", err)
+	}
+	if opts.Resources.MemorySwapMax, err = parseMemoryLimit(*memorySwap); err != nil {
+		return fmt.Errorf("--memory-swap: %w", err)
+	}
+	if math.IsNaN(*cpus) {
+		return fmt.Errorf("--cpus must be a number")
+	}
+	if *cpus < 0 {
+		return fmt.Errorf("--cpus must be positive")
+	}
+	if *cpus > 0 {
+		// cpu.max takes a quota per period, in microseconds, and the kernel refuses quotas below 1ms.
+		// More CPUs than the machine has would not limit anything, like Docker refuse them.
+		const period, minQuota = 100000, 1000
+		if *cpus < float64(minQuota)/period || *cpus > float64(runtime.NumCPU()) {
+			return fmt.Errorf("--cpus must be between %g and %d, the number of CPUs available", float64(minQuota)/period, runtime.NumCPU())
+		}
+		opts.Resources.CPUMax = fmt.Sprintf("%d %d", int64(*cpus*period), period)
+	}
+	if *cpuWeight != 0 {
+		if *cpuWeight > 10000 {
+			return fmt.Errorf("--cpu-weight must be between 1 and 10000")
+		}
+		opts.Resources.CPUWeight = strconv.FormatUint(*cpuWeight, 10)
+	}
+	if *pidsLimit < 0 {
+		return fmt.Errorf("--pids-limit must be positive")
+	}
+	if *pidsLimit > 0 {
+		opts.Resources.PidsMax = strconv.FormatInt(*pidsLimit, 10)
+	}
+
+	switch {
+	case *subIDs != "":
+		if len(uidMaps) > 0 || len(gidMaps) > 0 {
+			return fmt.Errorf("--subids cannot be combined with --uidmap or --gidmap")
+		}
+		if opts.UserNS, err = container.SubIDMappings(*subIDs); err != nil {
+			return err
+		}
+	case len(uidMaps) > 0 || len(gidMaps) > 0 || *userNS:
+		if len(uidMaps) == 0 {
+			uidMaps = idMapFlag{container.DefaultIDMap}
+		}
+		if len(gidMaps) == 0 {
+			gidMaps = uidMaps
+		}
+		opts.UserNS = &container.UserNamespace{UIDMappings: uidMaps, GIDMappings: gidMaps}
+	}
+
+	// In quiet mode the launch progress goes to stderr so stdout only carries the name
+	if *quiet {
+		opts.Output = os.Stderr
+	}
+	c, err := container.LaunchContainer(opts)
+	var missing *container.MissingInterpreterError
+	if errors.As(err, &missing) && missing.OnHost {
+		return fmt.Errorf("%w, run with --copy-interpreter to copy it from the host", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *quiet {
+		fmt.Println(c.Name)
+	}
+	if opts.TTY {
+		return attachContainer(c.Name, attach)
+	}
+	return nil
+}
+
+// listFlag collects values of a flag that may be repeated or given comma separated
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f = append(*f, item)
+		}
+	}
+	return nil
+}
+
+// repeatedFlag collects the values of a flag given several times, unlike listFlag values may contain commas
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// idMapFlag collects repeated containerID:hostID:size mappings
+type idMapFlag []container.IDMap
+
+func (f *idMapFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *idMapFlag) Set(value string) error {
+	m, err := container.ParseIDMap(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, m)
+	return nil
+}
+
+// parseMemoryLimit converts a size flag into the cgroup file format, empty means unset
+func parseMemoryLimit(value string) (string, error) {
+	if value == "" || value == "max" {
+		return value, nil
+	}
+	size, err := utils.ParseByteSize(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(size, 10), nil
+}
+
+func cmdPs(fs *flag.FlagSet, args []string) error {
+	quiet := fs.Bool("q", false, "only print container names")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if !*quiet {
+		container.ListContainers()
+		return nil
+	}
+
+	for _, c := range container.ContainersRunning {
+		fmt.Println(c.Name)
+	}
+	return nil
+}
+
+func cmdRm(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	// Keep going on failure so one bad name doesn't leave the rest behind
+	var errs []error
+	for _, name := range fs.Args() {
+		if err := container.DeleteContainer(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func cmdExec(fs *flag.FlagSet, args []string) error {
+	var env repeatedFlag
+	fs.Var(&env, "e", "set an environment variable as NAME=value, or NAME to pass the host's value, may be repeated")
+	workdir := fs.String("w", "", "working directory of the command (default: the container's)")
+	user := fs.String("u", "", "user[:group] to run the command as, by name or ID (default: the container's)")
+	tty := fs.Bool("t", false, "run the command on a pseudo-terminal")
+	interactive := fs.Bool("i", false, "forward the input to the command")
+	// The flag package doesn't combine single letter flags
+	both := fs.Bool("it", false, "shorthand for -i -t")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	opts := container.ExecOptions{
+		Args:        fs.Args()[1:],
+		Env:         env,
+		WorkingDir:  *workdir,
+		User:        *user,
+		TTY:         *tty || *both,
+		Interactive: *interactive || *both,
+	}
+	// A shell by default, interactive like it used to be
+	if len(opts.Args) == 0 {
+		opts.Args = []string{"/bin/sh"}
+		opts.Interactive = true
+		opts.TTY = opts.TTY || term.IsTerminal(int(os.Stdin.Fd()))
+	}
+
+	code, err := container.ExecContainer(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return exitStatus(code)
+	}
+	return nil
+}
+
+func cmdInspect(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	found := []container.Container{}
+	var errs []error
+	for _, name := range fs.Args() {
+		c, err := container.InspectContainer(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		found = append(found, c)
+	}
+
+	out, err := json.MarshalIndent(found, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	return errors.Join(errs...)
+}
+
+func cmdPull(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	img, err := container.PullImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pulled image %s (%s)\n", img.Reference(), img.ShortID())
+	return nil
+}
+
+func cmdImages(fs *flag.FlagSet, args []string) error {
+	quiet := fs.Bool("q", false, "only print image IDs")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	images, err := container.ListImages()
+	if err != nil {
+		return err
+	}
+
+	if *quiet {
+		for _, img := range images {
+			fmt.Println(img.ShortID())
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTAG\tID\tCREATED\tSIZE")
+	for _, img := range images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", img.Name, img.Tag, img.ShortID(),
+			img.Created.Format(time.RFC3339), utils.FormatByteSize(img.Size))
+	}
+	return w.Flush()
+}
+
+func cmdImage(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	switch sub := fs.Args(); sub[0] {
+	case "add":
+		if len(sub) != 3 {
+			return errUsage
+		}
+		img, err := container.AddImage(sub[1], sub[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added image %s (%s)\n", img.Reference(), img.ShortID())
+		return nil
+
+	case "import":
+		if len(sub) != 2 && len(sub) != 3 {
+			return errUsage
+		}
+		ref := ""
+		if len(sub) == 3 {
+			ref = sub[2]
+		}
+		images, err := container.ImportImage(sub[1], ref)
+		for _, img := range images {
+			fmt.Printf("Imported image %s (%s)\n", img.Reference(), img.ShortID())
+		}
+		return err
+
+	case "rm":
+		if len(sub) < 2 {
+			return errUsage
+		}
+		var errs []error
+		for _, ref := range sub[1:] {
+			if err := container.RemoveImage(ref); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+
+	default:
+		return errUsage
+	}
+}
+
+func cmdWait(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	code, err := container.WaitContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(code)
+	if code != 0 {
+		return exitStatus(code)
+	}
+	return nil
+}
+
+func cmdLogs(fs *flag.FlagSet, args []string) error {
+	var opts container.LogOptions
+	fs.BoolVar(&opts.Follow, "follow", false, "keep printing the output until the container exits")
+	fs.BoolVar(&opts.Follow, "f", false, "shorthand for --follow")
+	fs.IntVar(&opts.Tail, "tail", -1, "only print the last n lines, -1 for every line")
+	since := fs.String("since", "", "only print the output since a time (RFC 3339) or for a duration, e.g. 10m")
+	fs.BoolVar(&opts.Timestamps, "timestamps", false, "prefix every line with the time it was written")
+	fs.BoolVar(&opts.Timestamps, "t", false, "shorthand for --timestamps")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	if *since != "" {
+		var err error
+		if opts.Since, err = parseSince(*since); err != nil {
+			return fmt.Errorf("--since: %w", err)
+		}
+	}
+
+	return container.ContainerLogs(fs.Arg(0), opts)
+}
+
+// parseSince reads a point in time given as an RFC 3339 timestamp, or as a duration before now
+func parseSince(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected an RFC 3339 timestamp or a duration like 10m", value)
+	}
+	return time.Now().Add(-d), nil
+}
+
+func cmdAttach(fs *flag.FlagSet, args []string) error {
+	detachKeys := fs.String("detach-keys", container.DefaultDetachKeys, "key sequence that detaches from the container, empty to disable")
+	noStdin := fs.Bool("no-stdin", false, "do not forward the input to the container")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	opts := container.AttachOptions{Input: !*noStdin}
+	var err error
+	if opts.DetachKeys, err = container.ParseDetachKeys(*detachKeys); err != nil {
+		return fmt.Errorf("--detach-keys: %w", err)
+	}
+	return attachContainer(fs.Arg(0), opts)
+}
+
+// attachContainer attaches to a container and exits with its exit code, unless detached from it
+func attachContainer(name string, opts container.AttachOptions) error {
+	detached, err := container.AttachContainer(name, opts)
+	if err != nil {
+		return err
+	}
+	if detached {
+		fmt.Printf("\nDetached from container '%s', it keeps running\n", name)
+		return nil
+	}
+
+	code, err := container.WaitContainer(name)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return exitStatus(code)
+	}
+	return nil
+}
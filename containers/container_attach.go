@@ -0,0 +1,440 @@
+package container
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+const (
+	// The socket is in a directory of its own, private so nobody else can connect to it
+	attachSocketDir  = "attach"
+	attachSocketName = "attach.sock"
+
+	// DefaultDetachKeys leave an attached container running, like in Docker
+	DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+	// Output kept for the first client until it attaches, so `run -it` doesn't miss the first prompt
+	attachBacklogSize = 64 << 10
+	// Frames queued for a client before it is considered gone and disconnected
+	attachClientQueue = 1024
+	maxAttachFrame    = 1 << 20
+)
+
+// Frames exchanged over the console socket: a type byte, the payload length as a big endian uint32 and the payload
+const (
+	frameStdout = 1 // output of the container, to the clients
+	frameStderr = 2
+	frameInput  = 3 // input for the container's terminal, from a client
+	frameResize = 4 // rows and columns of a client's terminal as two big endian uint16
+)
+
+// AttachOptions describes how AttachContainer connects to a container
+type AttachOptions struct {
+	Input      bool   // forward our input, only a container started with -t has a terminal to read it
+	DetachKeys []byte // typed in that order they detach, nil disables detaching
+}
+
+// attachSocketPath returns the path of a container's console socket, relative like the container directory
+// so it stays short of the length limit of unix socket paths
+func attachSocketPath(containerDir string) string {
+	return filepath.Join(containerDir, attachSocketDir, attachSocketName)
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	_, err := w.Write(encodeFrame(kind, payload))
+	return err
+}
+
+func encodeFrame(kind byte, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxAttachFrame {
+		return 0, nil, fmt.Errorf("attach frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// attachServer serves the console socket of a container from its monitor. Every client gets everything
+// the container writes, and the input of all of them goes to the container's terminal.
+type attachServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	path     string
+	master   *os.File // the container's terminal, nil without -t
+	clients  map[*attachClient]bool
+	attached bool     // a client connected once, the backlog is not kept anymore
+	backlog  [][]byte // encoded frames, never more than fit in the queue of a client
+	size     int
+	closed   bool
+}
+
+type attachClient struct {
+	conn   net.Conn
+	frames chan []byte
+}
+
+// listenAttach starts serving the console socket of a container
+func listenAttach(c Container, master *os.File) (*attachServer, error) {
+	path := attachSocketPath(c.Location)
+	dir := filepath.Dir(path)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("failed to create console socket directory: %w", err)
+	}
+	// Mkdir leaves an existing one as it is
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create console socket directory: %w", err)
+	}
+
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create console socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to create console socket: %w", err)
+	}
+
+	s := &attachServer{listener: listener, path: path, master: master, clients: map[*attachClient]bool{}}
+	go s.serve()
+	return s, nil
+}
+
+func (s *attachServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &attachClient{conn: conn, frames: make(chan []byte, attachClientQueue)}
+		go s.send(client)
+
+		// The first client gets what was written before it came
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			close(client.frames)
+			return
+		}
+		s.clients[client] = true
+		if !s.attached {
+			for _, frame := range s.backlog {
+				client.frames <- frame
+			}
+			s.attached = true
+			s.backlog = nil
+			s.size = 0
+		}
+		s.mu.Unlock()
+
+		go s.receive(client)
+	}
+}
+
+// send writes the queued frames to a client, the connection is closed once the queue is
+func (s *attachServer) send(client *attachClient) {
+	defer client.conn.Close()
+	for frame := range client.frames {
+		if _, err := client.conn.Write(frame); err != nil {
+			s.remove(client)
+			// Drain until remove closes the queue
+			for range client.frames {
+			}
+			return
+		}
+	}
+}
+
+// receive handles the input and the window size changes of a client until it disconnects
+func (s *attachServer) receive(client *attachClient) {
+	defer s.remove(client)
+	for {
+		kind, payload, err := readFrame(client.conn)
+		if err != nil {
+			return
+		}
+		if s.master == nil {
+			continue
+		}
+
+		switch kind {
+		case frameInput:
+			s.master.Write(payload)
+		case frameResize:
+			if len(payload) == 4 {
+				size := &unix.Winsize{Row: binary.BigEndian.Uint16(payload[0:2]), Col: binary.BigEndian.Uint16(payload[2:4])}
+				unix.IoctlSetWinsize(int(s.master.Fd()), unix.TIOCSWINSZ, size)
+			}
+		}
+	}
+}
+
+// remove disconnects a client, once
+func (s *attachServer) remove(client *attachClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[client] {
+		delete(s.clients, client)
+		close(client.frames)
+	}
+}
+
+// broadcast sends output of the container to every client. A client too slow to keep up is disconnected
+// rather than holding up the container.
+func (s *attachServer) broadcast(kind byte, data []byte) {
+	frame := encodeFrame(kind, data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.attached {
+		s.backlog = append(s.backlog, frame)
+		s.size += len(frame)
+		for len(s.backlog) > 1 && (s.size > attachBacklogSize || len(s.backlog) > attachClientQueue) {
+			s.size -= len(s.backlog[0])
+			s.backlog = s.backlog[1:]
+		}
+		return
+	}
+	for client := range s.clients {
+		select {
+		case client.frames <- frame:
+		default:
+			delete(s.clients, client)
+			close(client.frames)
+		}
+	}
+}
+
+// Close stops accepting clients and disconnects the attached ones once they got all of the output
+func (s *attachServer) Close() {
+	s.listener.Close()
+	os.Remove(s.path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for client := range s.clients {
+		delete(s.clients, client)
+		close(client.frames)
+	}
+}
+
+// ParseDetachKeys parses a comma separated key sequence like ctrl-p,ctrl-q. Keys are single characters,
+// or ctrl- followed by a letter or one of @[\]^_. An empty sequence disables detaching.
+func ParseDetachKeys(spec string) ([]byte, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var keys []byte
+	for _, key := range strings.Split(spec, ",") {
+		switch {
+		case len(key) == 1:
+			keys = append(keys, key[0])
+		case len(key) == 6 && strings.HasPrefix(strings.ToLower(key), "ctrl-"):
+			c := key[5]
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			if c < '@' || c > '_' {
+				return nil, fmt.Errorf("invalid detach key %q", key)
+			}
+			keys = append(keys, c&0x1f)
+		default:
+			return nil, fmt.Errorf("invalid detach key %q, expected a character or ctrl-<key>", key)
+		}
+	}
+	return keys, nil
+}
+
+// detachFilter passes the input through until the detach sequence is typed. Keys that could start
+// the sequence are held back until it is clear whether they do.
+type detachFilter struct {
+	keys    []byte
+	matched int
+}
+
+// filter returns the input to forward, and whether the sequence was completed
+func (f *detachFilter) filter(input []byte) ([]byte, bool) {
+	if len(f.keys) == 0 {
+		return input, false
+	}
+
+	var out []byte
+	for _, b := range input {
+		if b == f.keys[f.matched] {
+			f.matched++
+			if f.matched == len(f.keys) {
+				return out, true
+			}
+			continue
+		}
+
+		// Not the sequence after all, the held back keys go through
+		out = append(out, f.keys[:f.matched]...)
+		f.matched = 0
+		if b == f.keys[0] {
+			f.matched = 1
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+// AttachContainer connects the user's terminal to the stdio of a container's process until it exits or the
+// detach keys are typed, and reports whether it detached. Several clients can be attached at once.
+func AttachContainer(name string, opts AttachOptions) (bool, error) {
+	c := findContainer(name)
+	if c == nil {
+		return false, fmt.Errorf("container '%s' not found", name)
+	}
+	if !containerAlive(*c) {
+		return false, fmt.Errorf("container '%s' is not running", name)
+	}
+
+	conn, err := net.Dial("unix", attachSocketPath(c.Location))
+	if err != nil {
+		return false, fmt.Errorf("cannot attach to container '%s': %w", name, err)
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	send := func(kind byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFrame(conn, kind, payload)
+	}
+
+	// Only the terminal of a -t container reads input, keys like ctrl-c go to it in raw mode
+	input := opts.Input && c.TTY
+	stdin := int(os.Stdin.Fd())
+	if input && term.IsTerminal(stdin) {
+		if oldState, err := term.MakeRaw(stdin); err == nil {
+			defer term.Restore(stdin, oldState)
+		} else {
+			fmt.Printf("Warning: could not put the terminal in raw mode: %v\n", err)
+		}
+	}
+
+	// The container's terminal follows the size of ours, the last attached client to resize wins
+	if c.TTY {
+		sendSize := func() {
+			if size, err := terminalSize(); err == nil {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint16(payload[0:2], size.Row)
+				binary.BigEndian.PutUint16(payload[2:4], size.Col)
+				send(frameResize, payload)
+			}
+		}
+		sendSize()
+
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				sendSize()
+			}
+		}()
+	}
+
+	detached := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	if input {
+		go func() {
+			if relayInput(stop, &detachFilter{keys: opts.DetachKeys}, send) {
+				close(detached)
+				conn.Close()
+			}
+		}()
+	}
+
+	// Output until the monitor hangs up, when the container exits
+	for {
+		kind, payload, err := readFrame(conn)
+		if err != nil {
+			break
+		}
+		switch kind {
+		case frameStdout:
+			os.Stdout.Write(payload)
+		case frameStderr:
+			os.Stderr.Write(payload)
+		}
+	}
+
+	select {
+	case <-detached:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// relayInput sends the user's input to the container until stop is closed or the detach keys are typed,
+// and reports whether they were. It only reads stdin once it polls readable, so no read is left behind
+// to swallow what the user types after the container exits.
+func relayInput(stop <-chan struct{}, detach *detachFilter, send func(byte, []byte) error) bool {
+	stdin := int(os.Stdin.Fd())
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		fds := []unix.PollFd{{Fd: int32(stdin), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 100) // ms
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return false
+		}
+		if n <= 0 || fds[0].Revents == 0 {
+			continue
+		}
+
+		n, err = unix.Read(stdin, buf)
+		if n <= 0 || err != nil {
+			// End of the input, like ctrl-d on a terminal
+			return false
+		}
+		data, done := detach.filter(buf[:n])
+		if len(data) > 0 {
+			if err := send(frameInput, data); err != nil {
+				return false
+			}
+		}
+		if done {
+			return true
+		}
+	}
+}
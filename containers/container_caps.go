@@ -0,0 +1,276 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capabilityNames is indexed by capability number, see capabilities(7)
+var capabilityNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// DefaultCapabilities is the reduced set a container gets, the same as Docker's defaults
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// ResolveCapabilities applies --cap-add and --cap-drop style lists to the default set.
+// Names are case insensitive, the CAP_ prefix is optional and ALL stands for every capability.
+// Drops are applied first, so "--cap-drop ALL --cap-add NET_ADMIN" leaves only CAP_NET_ADMIN.
+func ResolveCapabilities(add, drop []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, name := range DefaultCapabilities {
+		set[name] = true
+	}
+
+	for _, name := range drop {
+		if isAllCapabilities(name) {
+			set = map[string]bool{}
+			continue
+		}
+		capName, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		delete(set, capName)
+	}
+
+	for _, name := range add {
+		if isAllCapabilities(name) {
+			for _, capName := range capabilityNames {
+				set[capName] = true
+			}
+			continue
+		}
+		capName, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		set[capName] = true
+	}
+
+	// Keep the result in capability number order
+	var result []string
+	for _, capName := range capabilityNames {
+		if set[capName] {
+			result = append(result, capName)
+		}
+	}
+	return result, nil
+}
+
+func isAllCapabilities(name string) bool {
+	return strings.EqualFold(name, "ALL")
+}
+
+// normalizeCapability turns "net_admin" or "CAP_NET_ADMIN" into "CAP_NET_ADMIN"
+func normalizeCapability(name string) (string, error) {
+	capName := strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(capName, "CAP_") {
+		capName = "CAP_" + capName
+	}
+	if capabilityNumber(capName) < 0 {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return capName, nil
+}
+
+func capabilityNumber(name string) int {
+	for i, capName := range capabilityNames {
+		if capName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastCapability returns the highest capability the running kernel knows about
+func lastCapability() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		if last, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return last
+		}
+	}
+	return len(capabilityNames) - 1
+}
+
+// capabilitySet returns the numbers of the named capabilities the running kernel knows about
+func capabilitySet(names []string) map[int]bool {
+	last := lastCapability()
+	set := map[int]bool{}
+	for _, name := range names {
+		if n := capabilityNumber(name); n >= 0 && n <= last {
+			set[n] = true
+		}
+	}
+	return set
+}
+
+// dropCapabilities reduces the bounding and inheritable sets of the calling thread to the given capabilities.
+// It needs CAP_SETPCAP, so it runs before switchUser, which leaves a non-root user nothing else.
+func dropCapabilities(names []string) error {
+	keep := capabilitySet(names)
+
+	// 1. Bounding set
+	for c := 0; c <= lastCapability(); c++ {
+		if keep[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop %s from the bounding set: %w", capabilityName(c), err)
+		}
+	}
+
+	// 2. Inheritable set, the user switch keeps it
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	data[0].Inheritable, data[1].Inheritable = 0, 0
+	for c := range keep {
+		data[c/32].Inheritable |= 1 << uint(c%32)
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set inheritable capabilities: %w", err)
+	}
+	return nil
+}
+
+// applyCapabilities sets the effective, permitted and ambient sets of the calling thread once it switched to the
+// container's user. Like with Docker only root gets the capabilities, the user switch cleared them for anyone else
+// and they stay empty.
+func applyCapabilities(names []string, uid int) error {
+	keep := capabilitySet(names)
+	if uid != 0 {
+		keep = map[int]bool{}
+	}
+
+	// 3. Effective and permitted sets, the inheritable one is left as dropCapabilities set it
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	for i := range data {
+		data[i].Effective, data[i].Permitted = 0, 0
+	}
+	for c := range keep {
+		data[c/32].Effective |= 1 << uint(c%32)
+		data[c/32].Permitted |= 1 << uint(c%32)
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+
+	// 4. Ambient set
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+	for c := range keep {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("failed to raise ambient %s: %w", capabilityName(c), err)
+		}
+	}
+
+	return nil
+}
+
+// processCapabilities reads the effective capabilities of a running process from /proc/<pid>/status
+func processCapabilities(pid int) ([]string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed CapEff line %q", line)
+		}
+
+		names := []string{}
+		for c := 0; c < 64; c++ {
+			if mask&(1<<uint(c)) != 0 {
+				names = append(names, capabilityName(c))
+			}
+		}
+		return names, nil
+	}
+
+	return nil, fmt.Errorf("no CapEff in /proc/%d/status", pid)
+}
+
+func capabilityName(c int) string {
+	if c < len(capabilityNames) {
+		return capabilityNames[c]
+	}
+	return fmt.Sprintf("CAP_%d", c)
+}
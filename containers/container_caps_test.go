@@ -0,0 +1,84 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set in the helper process of TestApplyCapabilities to the UID it switches to
+const testCapsUIDEnv = "_MALPTAINER_TEST_CAPS_UID"
+
+// TestCapabilitiesHelper is run as a separate process by TestApplyCapabilities. It switches to a user
+// the way a container's init does and execs sleep, whose capabilities are then read from outside.
+func TestCapabilitiesHelper(t *testing.T) {
+	uid, err := strconv.Atoi(os.Getenv(testCapsUIDEnv))
+	if err != nil {
+		return
+	}
+
+	// Capabilities belong to a thread, like in init the exec has to come from the one they were set on
+	runtime.LockOSThread()
+	if err := dropCapabilities(DefaultCapabilities); err != nil {
+		t.Fatal(err)
+	}
+	if err := switchUser(processUser{UID: uid, GID: uid, Groups: []int{uid}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyCapabilities(DefaultCapabilities, uid); err != nil {
+		t.Fatal(err)
+	}
+	t.Fatal(syscall.Exec("/bin/sleep", []string{"sleep", "10"}, os.Environ()))
+}
+
+func TestApplyCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	sorted := append([]string(nil), DefaultCapabilities...)
+	sort.Strings(sorted)
+
+	tests := []struct {
+		uid  int
+		want []string
+	}{
+		{0, sorted},
+		{1000, []string{}},
+	}
+
+	for _, tt := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCapabilitiesHelper$")
+		cmd.Env = append(os.Environ(), testCapsUIDEnv+"="+strconv.Itoa(tt.uid))
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for the exec, the helper fails the test run if it got nowhere
+		var comm []byte
+		for i := 0; i < 100 && strings.TrimSpace(string(comm)) != "sleep"; i++ {
+			time.Sleep(20 * time.Millisecond)
+			comm, _ = os.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/comm")
+		}
+		caps, err := processCapabilities(cmd.Process.Pid)
+		cmd.Process.Kill()
+		cmd.Wait()
+		if strings.TrimSpace(string(comm)) != "sleep" {
+			t.Fatalf("uid %d: the helper did not exec sleep", tt.uid)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(caps)
+		if !reflect.DeepEqual(caps, tt.want) {
+			t.Errorf("uid %d: effective capabilities %v, want %v", tt.uid, caps, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CgroupRoot is where the cgroup v2 unified hierarchy is mounted
+var CgroupRoot = "/sys/fs/cgroup"
+
+// DefaultCgroupParent is the cgroup (relative to CgroupRoot) containers are created under
+const DefaultCgroupParent = "malptainer"
+
+// Controllers the container limits need enabled in the parent cgroups
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// cgroupV2Available checks that CgroupRoot is a cgroup v2 unified hierarchy
+func cgroupV2Available() bool {
+	_, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// setupCgroup creates the container's cgroup under the parent and writes its resource limits.
+// The returned path is empty when cgroup v2 is not available and no limits were requested.
+func setupCgroup(containerName, parent string, resources Resources, out io.Writer) (string, error) {
+	if !cgroupV2Available() {
+		if resources.IsSet() {
+			return "", fmt.Errorf("resource limits require cgroup v2 mounted at %s", CgroupRoot)
+		}
+		fmt.Fprintf(out, "Warning: cgroup v2 not found at %s, container will not get its own cgroup\n", CgroupRoot)
+		return "", nil
+	}
+
+	if parent == "" {
+		parent = DefaultCgroupParent
+	}
+	if Rootless && parent == DefaultCgroupParent {
+		parent = rootlessCgroupParent()
+	}
+	parent = filepath.Clean("/" + parent)
+
+	// Controllers have to be enabled in every ancestor's subtree_control for the files to show up
+	err := enableControllers(parent)
+
+	cgroupPath := filepath.Join(CgroupRoot, parent, containerName)
+	if err == nil {
+		err = os.Mkdir(cgroupPath, 0755)
+		if os.IsExist(err) {
+			err = nil
+		}
+	}
+
+	// Without privileges this only works inside a cgroup delegated to the user
+	if err != nil && Rootless && errors.Is(err, os.ErrPermission) && !resources.IsSet() {
+		fmt.Fprintf(out, "Warning: rootless: no delegated cgroup at %s, container will not get its own cgroup\n", filepath.Join(CgroupRoot, parent))
+		return "", nil
+	}
+	if err != nil {
+		if Rootless && errors.Is(err, os.ErrPermission) {
+			return "", fmt.Errorf("rootless: resource limits need a cgroup delegated to your user (%w)", err)
+		}
+		return "", fmt.Errorf("failed to create cgroup %s: %w", cgroupPath, err)
+	}
+
+	limits := []struct {
+		file  string
+		value string
+	}{
+		{"memory.max", resources.MemoryMax},
+		{"memory.swap.max", resources.MemorySwapMax},
+		{"cpu.max", resources.CPUMax},
+		{"cpu.weight", resources.CPUWeight},
+		{"pids.max", resources.PidsMax},
+	}
+
+	for _, limit := range limits {
+		if limit.value == "" {
+			continue
+		}
+		if err := writeCgroupFile(cgroupPath, limit.file, limit.value); err != nil {
+			os.Remove(cgroupPath)
+			return "", err
+		}
+	}
+
+	return cgroupPath, nil
+}
+
+// enableControllers enables the needed controllers from the root down to the parent cgroup
+func enableControllers(parent string) error {
+	current := CgroupRoot
+	parts := strings.Split(strings.Trim(parent, "/"), "/")
+
+	for i := 0; i <= len(parts); i++ {
+		available, err := os.ReadFile(filepath.Join(current, "cgroup.controllers"))
+		if err != nil {
+			return fmt.Errorf("failed to read controllers of %s: %w", current, err)
+		}
+
+		var enable []string
+		for _, controller := range cgroupControllers {
+			if containsWord(string(available), controller) {
+				enable = append(enable, "+"+controller)
+			}
+		}
+		if len(enable) > 0 {
+			err := writeCgroupFile(current, "cgroup.subtree_control", strings.Join(enable, " "))
+			// Rootless, the ancestors above the delegated cgroup belong to root and are already set up by systemd
+			if err != nil && !(Rootless && errors.Is(err, os.ErrPermission)) {
+				return err
+			}
+		}
+
+		if i == len(parts) {
+			break
+		}
+		current = filepath.Join(current, parts[i])
+		if err := os.Mkdir(current, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to create cgroup %s: %w", current, err)
+		}
+	}
+
+	return nil
+}
+
+// addProcessToCgroup moves a process into the cgroup
+func addProcessToCgroup(cgroupPath string, pid int) error {
+	return writeCgroupFile(cgroupPath, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// removeCgroup deletes a container's cgroup, its processes must already be gone
+func removeCgroup(cgroupPath string) error {
+	if cgroupPath == "" {
+		return nil
+	}
+
+	err := os.Remove(cgroupPath)
+	if err != nil && !os.IsNotExist(err) {
+		if errors.Is(err, syscall.EBUSY) {
+			return fmt.Errorf("cgroup %s still has processes in it", cgroupPath)
+		}
+		return fmt.Errorf("failed to remove cgroup %s: %w", cgroupPath, err)
+	}
+	return nil
+}
+
+func writeCgroupFile(cgroupPath, file, value string) error {
+	if err := os.WriteFile(filepath.Join(cgroupPath, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %w", value, filepath.Join(cgroupPath, file), err)
+	}
+	return nil
+}
+
+func containsWord(s, word string) bool {
+	for _, field := range strings.Fields(s) {
+		if field == word {
+			return true
+		}
+	}
+	return false
+}
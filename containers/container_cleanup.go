@@ -7,71 +7,72 @@ import (
 	"time"
 )
 
-func cleanupContainers() {
-	cleanupRunningContainers()
-	cleanupStartingContainers()
+// cleanupContainers stops and removes the named containers
+func cleanupContainers(names []string) {
+	cleanupRunningContainers(selectContainers(ContainersRunning, names))
+	cleanupStartingContainers(selectContainers(ContainersStarting, names))
+	cleanupStoppedContainers(selectContainers(ContainerStopped, names))
 }
 
-// Check if a process is still running by sending signal 0
-func processExists(pid int) bool {
-	err := syscall.Kill(pid, 0)
-	return err == nil
+// selectContainers returns the containers of the list that are named
+func selectContainers(list []Container, names []string) []Container {
+	var selected []Container
+	for _, c := range list {
+		if containsString(names, c.Name) {
+			selected = append(selected, c)
+		}
+	}
+	return selected
 }
 
-// Kill a process and wait until it's actually gone
-func killAndWait(pid int, timeout time.Duration) error {
+// Kill a process and wait until it's actually gone. The start time (0 when unknown) makes sure
+// a process that reused the PID is left alone.
+func killAndWait(pid int, startTime uint64, timeout time.Duration) error {
 	// First check if process exists
-	if !processExists(pid) {
+	p, err := openProcess(pid, startTime)
+	if err != nil {
 		return nil // Already dead
 	}
+	defer p.Close()
 
 	// Try SIGTERM first
-	syscall.Kill(pid, syscall.SIGTERM)
-
-	// Wait for process to die (check every 100ms)
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		if !processExists(pid) {
-			return nil // Process died
-		}
-		time.Sleep(100 * time.Millisecond)
+	p.signal(syscall.SIGTERM)
+	if p.wait(timeout) {
+		return nil // Process died
 	}
 
 	// Process didn't die, force kill with SIGKILL
-	syscall.Kill(pid, syscall.SIGKILL)
-
-	// Wait again for SIGKILL to take effect
-	deadline = time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		if !processExists(pid) {
-			return nil // Process died
-		}
-		time.Sleep(100 * time.Millisecond)
+	p.signal(syscall.SIGKILL)
+	if p.wait(timeout) {
+		return nil // Process died
 	}
 
-	// Check one last time
-	if processExists(pid) {
-		return fmt.Errorf("process %d still exists after SIGKILL", pid)
-	}
-
-	return nil
+	return fmt.Errorf("process %d still exists after SIGKILL", pid)
 }
 
-func cleanupRunningContainers() {
+func cleanupRunningContainers(containers []Container) {
 	// Remove all running containers
-	for _, container := range ContainersRunning {
+	for _, container := range containers {
 		// Kill the namespace process if it exists
 		if container.NamespacePID > 0 {
 			fmt.Printf("Killing namespace process (PID %d) for container: %s\n", container.NamespacePID, container.Name)
 
-			err := killAndWait(container.NamespacePID, 5*time.Second)
+			err := killAndWait(container.NamespacePID, container.StartTime, 5*time.Second)
 			if err != nil {
 				fmt.Printf("Warning: %v\n", err)
 			} else {
 				fmt.Printf("Confirmed process %d is terminated\n", container.NamespacePID)
 			}
+			waitForMonitor(container)
 		}
 
+		// remove the container's cgroup, its processes are gone by now
+		if err := removeCgroup(container.CgroupPath); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		stopPortProxy(container)
+		teardownNetwork(container)
+
 		// remove the container directory inside the .containers folder
 		err := os.RemoveAll(container.Location)
 		if err != nil {
@@ -79,25 +80,33 @@ func cleanupRunningContainers() {
 		}
 	}
 
-	if len(ContainersRunning) > 0 {
+	if len(containers) > 0 {
 		fmt.Println("Cleaned-up all running containers.")
 	}
 }
 
-func cleanupStartingContainers() {
+func cleanupStartingContainers(containers []Container) {
 	// Remove all containers that are currently starting up..
-	for _, container := range ContainersStarting {
+	for _, container := range containers {
 		// Kill the namespace process if it exists
 		if container.NamespacePID > 0 {
 			fmt.Printf("Killing namespace process (PID %d) for container: %s\n", container.NamespacePID, container.Name)
 			
-			err := killAndWait(container.NamespacePID, 5*time.Second)
+			err := killAndWait(container.NamespacePID, container.StartTime, 5*time.Second)
 			if err != nil {
 				fmt.Printf("Warning: %v\n", err)
 			} else {
 				fmt.Printf("Confirmed process %d is terminated\n", container.NamespacePID)
 			}
+			waitForMonitor(container)
+		}
+
+		// remove the container's cgroup, its processes are gone by now
+		if err := removeCgroup(container.CgroupPath); err != nil {
+			fmt.Printf("Warning: %v\n", err)
 		}
+		stopPortProxy(container)
+		teardownNetwork(container)
 
 		// remove the container directory inside the .containers folder
 		err := os.RemoveAll(container.Location)
@@ -106,7 +115,27 @@ func cleanupStartingContainers() {
 		}
 	}
 
-	if len(ContainersStarting) > 0 {
+	if len(containers) > 0 {
 		fmt.Println("Cleaned-up all starting containers.")
 	}
 }
+
+func cleanupStoppedContainers(containers []Container) {
+	// Stopped containers have no process left, only their cgroup and directory
+	for _, container := range containers {
+		if err := removeCgroup(container.CgroupPath); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		stopPortProxy(container)
+		teardownNetwork(container)
+
+		err := os.RemoveAll(container.Location)
+		if err != nil {
+			fmt.Printf("Could not remove stopped container: %s\n", container.Name)
+		}
+	}
+
+	if len(containers) > 0 {
+		fmt.Println("Cleaned-up all stopped containers.")
+	}
+}
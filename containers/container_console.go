@@ -0,0 +1,68 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// console is the pseudo-terminal of a container started with -t
+type console struct {
+	master *os.File // kept by the monitor, which relays it to the attached clients
+	slave  *os.File // stdin, stdout, stderr and controlling terminal of the init process
+}
+
+// openConsole allocates a pseudo-terminal for a container started with -t, with the size of ours
+func openConsole(userNS *UserNamespace, out io.Writer) (*console, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate a terminal: %w", err)
+	}
+
+	// Unlock the slave and find its number, what grantpt and ptsname do in C
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to unlock the terminal: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to get the terminal number: %w", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open the terminal: %w", err)
+	}
+
+	// Hand it to container root, host root is nobody in a user namespace. Rootless, it is ours already.
+	if userNS != nil && !Rootless {
+		uid, uidOK := mapToHost(0, userNS.UIDMappings)
+		gid, gidOK := mapToHost(0, userNS.GIDMappings)
+		if uidOK && gidOK {
+			if err := slave.Chown(uid, gid); err != nil {
+				fmt.Fprintf(out, "Warning: could not hand the terminal to the container's root: %v\n", err)
+			}
+		}
+	}
+
+	// The application starts with the size of the user's terminal
+	if size, err := terminalSize(); err == nil {
+		unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, size)
+	}
+	return &console{master: master, slave: slave}, nil
+}
+
+// Close closes both ends, the monitor and the init process have their own copies
+func (c *console) Close() {
+	c.master.Close()
+	c.slave.Close()
+}
+
+// terminalSize returns the window size of the user's terminal
+func terminalSize() (*unix.Winsize, error) {
+	return unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+}
@@ -1,34 +1,54 @@
 package container
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 	"malptainer/utils"
 	"github.com/otiai10/copy"
 )
 
+// resolveRootfsSource returns the root filesystem a container is created from: the selected image, or ./root_fs without one
+func resolveRootfsSource(imageRef string) (string, Image, error) {
+	if imageRef == "" {
+		return "./root_fs", Image{}, nil
+	}
+
+	image, err := FindImage(imageRef)
+	if err != nil {
+		return "", Image{}, err
+	}
+	return imageRootfs(image.ID), image, nil
+}
+
 // Prepare the new container's rootfs & folders
-func prepareNewContainerRootFs() Container {
-	fmt.Println("Preparing root filesystem..")
-	// We are enforcing the alpine rootfs for now. Otherwise, further security checks are required during the /proc mount and other steps.
+func prepareNewContainerRootFs(opts LaunchOptions) (Container, error) {
+	fmt.Fprintln(opts.Output, "Preparing root filesystem..")
 	containerName := utils.GenerateRandomContainerName(7)
 
 	// 1. First make a directory called .containers.
 	// 2. Inside it make a directory with the naming convention of container-random. Keep track of the list in a list of structs.
 	// All containers are deleted when the program exits for now.
-	// 3. Copy the init_root_fs dir into it with the name root_fs.
+	// 3. Overlay the base rootfs, or copy it into the container dir with the name root_fs.
 
-	containerPath := ".containers/" + containerName
-	rootFsPath := containerPath + "/root_fs"
-	os.MkdirAll(rootFsPath, 0755)
+	rootFsSource, image, err := resolveRootfsSource(opts.Image)
+	if err != nil {
+		return Container{}, err
+	}
 
-	// container dir is created. Now copy the base rootfs over there
-	cp_err := copy.Copy("./root_fs/", rootFsPath)
-	if cp_err != nil {
-		log.Fatal(cp_err)
+	containerPath := ContainersRoot + "/" + containerName
+	rootFsPath := containerPath + "/root_fs"
+	if err := makeStoreDir(ContainersRoot); err != nil {
+		return Container{}, fmt.Errorf("failed to create container directory: %w", err)
+	}
+	if err := os.MkdirAll(rootFsPath, 0755); err != nil {
+		return Container{}, fmt.Errorf("failed to create container directory: %w", err)
 	}
 
 	newContainer := Container{
@@ -36,13 +56,64 @@ func prepareNewContainerRootFs() Container {
 		Location:       containerPath,
 		RootfsLocation: rootFsPath,
 		NamespacePID:   0, // Will be set when namespaces are launched
+		CreatedAt:      time.Now(),
+		Status:         StatusStarting,
+		UserNS:         opts.UserNS,
+		Storage:        StorageCopy,
+	}
+	if image.ID != "" {
+		newContainer.Image, newContainer.ImageID = image.Reference(), image.ID
+	}
+
+	// The overlay is mounted by the init process, here we only make sure it will work
+	reason := overlayUnavailable(opts)
+	if reason == "" {
+		lower, err := absolutePath(filepath.Clean(rootFsSource))
+		if err != nil {
+			os.RemoveAll(containerPath)
+			return Container{}, err
+		}
+		absContainerPath, err := absolutePath(containerPath)
+		if err != nil {
+			os.RemoveAll(containerPath)
+			return Container{}, err
+		}
+		upper, work := overlayDirs(absContainerPath)
+
+		if err := prepareOverlay(lower, upper, work, rootFsPath); err != nil {
+			reason = fmt.Sprintf("overlay mount failed: %v", err)
+			os.RemoveAll(upper)
+			os.RemoveAll(work)
+		} else {
+			newContainer.Storage = StorageOverlay
+			newContainer.LowerDir, newContainer.UpperDir, newContainer.WorkDir = lower, upper, work
+			return newContainer, nil
+		}
+	}
+	fmt.Fprintf(opts.Output, "Copying the root filesystem instead of using overlayfs: %s\n", reason)
+
+	// container dir is created. Now copy the base rootfs over there
+	cp_err := copy.Copy(rootFsSource+"/", rootFsPath)
+	if cp_err != nil {
+		os.RemoveAll(containerPath)
+		return Container{}, fmt.Errorf("failed to copy root filesystem: %w", cp_err)
+	}
+
+	// With a user namespace the files have to be owned by the mapped IDs to appear as their original owners.
+	// Rootless copies are owned by the calling user already, which is what container root maps to.
+	if opts.UserNS != nil && !Rootless {
+		if err := chownToUserNamespace(rootFsPath, opts.UserNS, opts.Output); err != nil {
+			os.RemoveAll(containerPath)
+			return Container{}, err
+		}
 	}
 
-	return newContainer
+	return newContainer, nil
 }
 
 // Prepare the temporary network files like /etc/hosts, /etc/hostname, /etc/resolv.conf
-func prepareTempNetworkFiles(container Container) {
+// Their content depends on the network mode of the container.
+func prepareTempNetworkFiles(container Container, out io.Writer) {
 	
 	// First /etc/hosts
 	etcHostsContent := `127.0.0.1		localhost %s
@@ -52,94 +123,273 @@ func prepareTempNetworkFiles(container Container) {
 
 	etcHostsContentFormatted := fmt.Sprintf(etcHostsContent, container.Name)
 	etcHostnameContentFormatted := fmt.Sprintf(etcHostnameContent, container.Name)
+
+	// Bridged containers resolve their own name to their address, the others share
+	// the hosts file of the network they joined with their name added
+	switch {
+	case container.Network != nil:
+		etcHostsContentFormatted += fmt.Sprintf("\n%s\t\t%s", container.Network.IPAddress, container.Name)
+	case container.NetworkMode == NetworkHost:
+		if hosts, err := os.ReadFile("/etc/hosts"); err == nil {
+			etcHostsContentFormatted = fmt.Sprintf("%s\n127.0.0.1\t\t%s", strings.TrimRight(string(hosts), "\n"), container.Name)
+		}
+	case strings.HasPrefix(container.NetworkMode, networkContainerPrefix):
+		if target := findContainer(strings.TrimPrefix(container.NetworkMode, networkContainerPrefix)); target != nil {
+			if hosts, err := os.ReadFile(target.Location + "/hosts"); err == nil {
+				address := "127.0.0.1"
+				if target.Network != nil {
+					address = target.Network.IPAddress
+				}
+				etcHostsContentFormatted = fmt.Sprintf("%s\n%s\t\t%s", strings.TrimRight(string(hosts), "\n"), address, container.Name)
+			}
+		}
+	}
+
 	err := os.WriteFile(container.Location + "/hosts", []byte(etcHostsContentFormatted), 0644)
 	if err != nil {
-		fmt.Printf("Could not write the /etc/hosts file temporarily")
+		fmt.Fprintf(out, "Could not write the /etc/hosts file temporarily")
 	}
 
 	err = os.WriteFile(container.Location + "/hostname", []byte(etcHostnameContentFormatted), 0644)
 	if err != nil {
-		fmt.Printf("Could not write the /etc/hostname file temporarily")
+		fmt.Fprintf(out, "Could not write the /etc/hostname file temporarily")
 	}
 
-	// Copy /etc/resolv.conf
-	cp_err := copy.Copy("/etc/resolv.conf", container.Location + "/resolv.conf")
-	if cp_err != nil {
-		fmt.Printf("Could not copy /etc/resolv.conf file temporarily")
+	// Then /etc/resolv.conf
+	err = os.WriteFile(container.Location + "/resolv.conf", containerResolvConf(container), 0644)
+	if err != nil {
+		fmt.Fprintf(out, "Could not write the /etc/resolv.conf file temporarily")
 	}
 
 }
 
 // Launch new namespaces using the re-exec pattern (like runc)
-// Creates new mount, PID, cgroup, UTS, and network namespaces, then re-execs
-// the current binary as init to set up the container environment
-func launchNamespaces(container *Container, binaryPath string) error {
-	fmt.Println("Launching new namespaces using re-exec pattern...")
+// Creates new mount, PID, UTS, and network namespaces, then re-execs
+// the current binary as init to set up the container environment.
+// The init process waits on a sync pipe until it has been moved into the container's
+// cgroup and only then creates its cgroup namespace, so the namespace is rooted there.
+// It is started by the container's monitor, which holds back the exit status until the returned
+// function is called, once the container has been saved as running. console is the container's
+// pseudo-terminal with -t, nil otherwise.
+func launchNamespaces(container *Container, opts LaunchOptions, console *console) (func(), error) {
+	binaryPath := opts.BinaryPath
+	fmt.Fprintln(opts.Output, "Launching new namespaces using re-exec pattern...")
 
 	// Copy the binary from host to container's /home/container/container-app
-	containerAppDir := container.RootfsLocation + "/home/container"
+	// With an overlay it goes into the upper dir, the merged view only exists inside the container
+	containerAppDir := writableRootfs(container) + "/home/container"
 	containerAppPath := containerAppDir + "/container-app"
 
 	// Create the /home/container directory if it doesn't exist
 	if err := os.MkdirAll(containerAppDir, 0755); err != nil {
-		return fmt.Errorf("failed to create /home/container directory: %w", err)
+		return nil, fmt.Errorf("failed to create /home/container directory: %w", err)
 	}
 
 	// Copy the binary
 	if err := copy.Copy(binaryPath, containerAppPath); err != nil {
-		return fmt.Errorf("failed to copy binary to container: %w", err)
+		return nil, fmt.Errorf("failed to copy binary to container: %w", err)
 	}
 
 	// Make it executable
 	if err := os.Chmod(containerAppPath, 0755); err != nil {
-		return fmt.Errorf("failed to make binary executable: %w", err)
+		return nil, fmt.Errorf("failed to make binary executable: %w", err)
+	}
+
+	// Hand the binary to container root when running in a user namespace
+	if container.UserNS != nil && !Rootless {
+		if err := chownToUserNamespace(containerAppDir, container.UserNS, opts.Output); err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Printf("Copied %s to container at /home/container/container-app\n", binaryPath)
+	fmt.Fprintf(opts.Output, "Copied %s to container at /home/container/container-app\n", binaryPath)
 
 	// Get absolute paths for the container
 	absRootfs, err := absolutePath(container.RootfsLocation)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute rootfs path: %w", err)
+		return nil, fmt.Errorf("failed to get absolute rootfs path: %w", err)
 	}
 
 	absContainerDir, err := absolutePath(container.Location)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute container dir path: %w", err)
+		return nil, fmt.Errorf("failed to get absolute container dir path: %w", err)
+	}
+
+	// Create the container's cgroup and apply its resource limits
+	cgroupPath, err := setupCgroup(container.Name, opts.CgroupParent, opts.Resources, opts.Output)
+	if err != nil {
+		return nil, err
+	}
+	container.CgroupPath = cgroupPath
+
+	// Empty for unconfined containers
+	seccompPath := ""
+	if container.SeccompProfile != SeccompUnconfined {
+		seccompPath = filepath.Join(absContainerDir, seccompProfileFile)
+	}
+
+	config := InitConfig{
+		RootfsPath:   absRootfs,
+		ContainerDir: absContainerDir,
+		BinaryPath:   containerBinaryPath,
+		Hostname:     container.Name,
+		UserNS:       container.UserNS != nil,
+		Rootless:     Rootless,
+		Capabilities: container.Capabilities,
+		SeccompPath:  seccompPath,
+		NetMode:      container.NetworkMode,
+		NetNSFD:      -1,
+		Process:      container.Process,
+		Init:         container.Init,
+	}
+	if console != nil {
+		config.Console = console.slave.Name()
+	}
+	if container.Storage == StorageOverlay {
+		config.Overlay = overlayOptions(container.LowerDir, container.UpperDir, container.WorkDir)
+	}
+
+	// The veth peer is created once the init process exists, under a temporary name
+	if container.Network != nil {
+		_, config.NetPeer = vethNames(container.Name)
+		config.NetAddress = fmt.Sprintf("%s/%d", container.Network.IPAddress, container.Network.PrefixLen)
+		config.NetGateway = container.Network.Gateway
+	}
+
+	// The network namespace to join in container:<name> mode
+	var netNS *os.File
+	if strings.HasPrefix(container.NetworkMode, networkContainerPrefix) {
+		if netNS, err = networkNamespaceOf(container.NetworkMode); err != nil {
+			return nil, err
+		}
+		defer netNS.Close()
+	}
+
+	// The monitor starts the init process as its own child, so it can reap it and record how it exited
+	release, err := startMonitor(container, config, netNS, console)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(opts.Output, "Launched container init process with PID %d for container: %s\n", container.NamespacePID, container.Name)
+
+	return release, nil
+}
+
+// startInit re-execs the binary as the init process of a container in new namespaces and waits until it
+// has set the container up and exec'd the application. It runs in the container's monitor process,
+// which captures the output of the container into its log, unless it runs on the console of a -t container.
+func startInit(container Container, config InitConfig, netNS *os.File, console *os.File, output *outputCapture) (*exec.Cmd, error) {
+	// The init process reads its configuration from one pipe, blocks on the second until the parent
+	// is done setting it up and reports how its setup went on the third
+	configRead, configWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config pipe: %w", err)
+	}
+	defer configWrite.Close()
+	syncRead, syncWrite, err := os.Pipe()
+	if err != nil {
+		configRead.Close()
+		return nil, fmt.Errorf("failed to create sync pipe: %w", err)
 	}
+	defer syncWrite.Close()
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		configRead.Close()
+		syncRead.Close()
+		return nil, fmt.Errorf("failed to create status pipe: %w", err)
+	}
+	defer statusRead.Close()
 
 	// Re-exec pattern: run ourselves with "init" argument
 	// The child process will run RunContainerInit() which does all the setup
 	cmd := exec.Command("/proc/self/exe", "init")
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWNS |     // Mount namespace
-			syscall.CLONE_NEWPID |            // PID namespace
-			syscall.CLONE_NEWCGROUP |         // Cgroup namespace
-			syscall.CLONE_NEWUTS |            // UTS namespace
-			syscall.CLONE_NEWNET,             // Network namespace
-		Setpgid: true, // Create new process group
-	}
-
-	// Pass configuration to the init process via environment variables
-	cmd.Env = append(os.Environ(),
-		"CNTR_ROOTFS="+absRootfs,
-		"CNTR_DIR="+absContainerDir,
-		"CNTR_BINARY=/home/container/container-app",
-		"CNTR_HOSTNAME="+container.Name,
-	)
+		Cloneflags: syscall.CLONE_NEWNS | // Mount namespace
+			syscall.CLONE_NEWPID | // PID namespace
+			syscall.CLONE_NEWUTS | // UTS namespace
+			syscall.CLONE_NEWIPC, // IPC namespace
+		Setsid: true, // Create new session and process group, the console of a -t container becomes its terminal
+	}
+	cmd.ExtraFiles = []*os.File{configRead, syncRead, statusWrite} // fd 3, 4 and 5 in the child
+	// Not a single variable of the host, the container process gets its own environment from the config
+	cmd.Env = []string{}
+	cmd.Stdout = output.stdout
+	cmd.Stderr = output.stderr
+	if console != nil {
+		cmd.Stdin = console
+		cmd.Stdout = console
+		cmd.Stderr = console
+	}
+
+	// Network namespace, host mode stays in the host's and container mode joins another container's
+	switch {
+	case container.NetworkMode == NetworkHost:
+	case netNS != nil:
+		cmd.ExtraFiles = append(cmd.ExtraFiles, netNS)
+		config.NetNSFD = initNetNSFD
+	default:
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	// User namespace, the mappings are written before the init process is exec'd
+	if container.UserNS != nil {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = toSysProcIDMap(container.UserNS.UIDMappings)
+		cmd.SysProcAttr.GidMappings = toSysProcIDMap(container.UserNS.GIDMappings)
+		// Unprivileged users may only write gid_map once setgroups is denied
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = !Rootless
+		// Become root of the new namespace, otherwise the exec drops all capabilities
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: Rootless}
+	}
 
 	// Start the init process in new namespaces
 	err = cmd.Start()
+	configRead.Close()
+	syncRead.Close()
+	statusWrite.Close()
 	if err != nil {
-		return fmt.Errorf("failed to start container init process: %w", err)
+		return nil, fmt.Errorf("failed to start container init process: %w", err)
+	}
+
+	// abort stops the init process while it waits for us
+	abort := func(err error) (*exec.Cmd, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
 	}
 
-	// Store the PID of the namespace process
-	container.NamespacePID = cmd.Process.Pid
+	// Hand over the configuration, the init process reads it before anything else
+	if err := json.NewEncoder(configWrite).Encode(config); err != nil {
+		return abort(fmt.Errorf("failed to send the configuration to the container init process: %w", err))
+	}
+	configWrite.Close()
 
-	fmt.Printf("Launched container init process with PID %d for container: %s\n", container.NamespacePID, container.Name)
+	// Move the init process into the container's cgroup before it gets to exec the application
+	if container.CgroupPath != "" {
+		if err := addProcessToCgroup(container.CgroupPath, cmd.Process.Pid); err != nil {
+			return abort(err)
+		}
+	}
+
+	// Plug the init process's network namespace into the bridge
+	if container.Network != nil {
+		if err := attachContainerNetwork(&container, cmd.Process.Pid); err != nil {
+			return abort(err)
+		}
+	}
+
+	// Let the init process continue its setup
+	if _, err := syncWrite.Write([]byte{0}); err != nil {
+		return abort(fmt.Errorf("failed to signal container init process: %w", err))
+	}
+
+	// Wait for the outcome of the setup, the pipe is closed by the exec of the application
+	if err := readInitStatus(statusRead); err != nil {
+		return abort(err)
+	}
 
-	return nil
+	return cmd, nil
 }
 
 // absolutePath returns the absolute path of a given path
@@ -1,10 +1,127 @@
 package container
 
+import (
+	"io"
+	"time"
+)
+
+// Container states as stored in the state file
+const (
+	StatusStarting = "starting"
+	StatusRunning  = "running"
+	StatusStopped  = "stopped"
+)
+
+// ContainersRoot is the directory holding one sub-directory per container
+var ContainersRoot = ".containers"
+
 type Container struct {
-	Name           string
-	Location       string
-	RootfsLocation string
-	NamespacePID   int
+	Name           string    `json:"name"`
+	Location       string    `json:"location"`
+	RootfsLocation string    `json:"rootfs_location"`
+	Image          string    `json:"image,omitempty"` // reference of the image, empty for ./root_fs
+	ImageID        string    `json:"image_id,omitempty"`
+	Storage        string    `json:"storage"`             // StorageOverlay or StorageCopy
+	LowerDir       string    `json:"lower_dir,omitempty"` // overlay only, the read-only source
+	UpperDir       string    `json:"upper_dir,omitempty"`
+	WorkDir        string    `json:"work_dir,omitempty"`
+	NamespacePID   int       `json:"pid"`
+	StartTime      uint64    `json:"process_start_time"` // in clock ticks since boot, see proc(5)
+	CreatedAt      time.Time `json:"created_at"`
+	Status         string    `json:"status"`
+	Resources      Resources `json:"resources"`
+	CgroupPath     string    `json:"cgroup_path,omitempty"`
+
+	// The monitor process waiting for the init process
+	MonitorPID       int    `json:"monitor_pid,omitempty"`
+	MonitorStartTime uint64 `json:"monitor_start_time,omitempty"`
+	// Recorded by the monitor when the init process exits, 128 plus the signal number when it was killed
+	ExitCode   int       `json:"exit_code"`
+	ExitSignal string    `json:"exit_signal,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	Process ProcessSpec `json:"process"`
+	TTY     bool        `json:"tty,omitempty"`  // runs on a pseudo-terminal, which takes input from attached clients
+	Init    bool        `json:"init,omitempty"` // the binary runs under a minimal init that forwards signals and reaps zombies
+	// Rotation of the stdout and stderr log, see container_logs.go
+	Log LogConfig `json:"log"`
+
+	UserNS *UserNamespace `json:"user_namespace,omitempty"`
+
+	Capabilities   []string `json:"capabilities"`
+	SeccompProfile string   `json:"seccomp_profile"` // "default", "unconfined" or the profile file
+	// Read from /proc when inspecting a running container, never stored
+	EffectiveCapabilities []string `json:"effective_capabilities,omitempty"`
+
+	NetworkMode string `json:"network_mode"` // bridge, none, host or container:<name>
+	// Only set in bridge mode
+	Network *NetworkConfig `json:"network,omitempty"`
+
+	// Published ports and the proxy process forwarding them
+	Ports          []PortMapping `json:"ports,omitempty"`
+	ProxyPID       int           `json:"proxy_pid,omitempty"`
+	ProxyStartTime uint64        `json:"proxy_start_time,omitempty"`
+}
+
+// NetworkConfig describes a container's attachment to the bridge network
+type NetworkConfig struct {
+	Bridge    string `json:"bridge"`
+	IPAddress string `json:"ip_address"`
+	PrefixLen int    `json:"prefix_len"`
+	Gateway   string `json:"gateway"`
+	HostVeth  string `json:"host_veth"` // host side of the veth pair
+}
+
+// IDMap maps a range of IDs inside the container to IDs on the host
+type IDMap struct {
+	ContainerID int `json:"container_id"`
+	HostID      int `json:"host_id"`
+	Size        int `json:"size"`
+}
+
+// UserNamespace holds the UID/GID mappings of a container running in its own user namespace
+type UserNamespace struct {
+	UIDMappings []IDMap `json:"uid_mappings"`
+	GIDMappings []IDMap `json:"gid_mappings"`
+}
+
+// Resources holds the cgroup v2 limits of a container, in the format of their interface files.
+// Empty values are left at the kernel default.
+type Resources struct {
+	MemoryMax     string `json:"memory.max,omitempty"`
+	MemorySwapMax string `json:"memory.swap.max,omitempty"`
+	CPUMax        string `json:"cpu.max,omitempty"`
+	CPUWeight     string `json:"cpu.weight,omitempty"`
+	PidsMax       string `json:"pids.max,omitempty"`
+}
+
+// IsSet reports whether any limit was requested
+func (r Resources) IsSet() bool {
+	return r != Resources{}
+}
+
+// LaunchOptions describes how a new container should be launched
+type LaunchOptions struct {
+	BinaryPath   string
+	Args         []string // arguments passed to the binary
+	Env          []string // NAME=value, or NAME to take the host's value, on top of the image's environment
+	WorkingDir   string   // the image's, or / when empty
+	User         string   // user[:group] by name or ID, the image's or root when empty
+	Resources    Resources
+	CgroupParent string         // relative to CgroupRoot, DefaultCgroupParent when empty
+	UserNS       *UserNamespace // nil runs the container in the host user namespace
+	CapAdd       []string       // capabilities added to DefaultCapabilities
+	CapDrop      []string       // capabilities removed from DefaultCapabilities
+	Seccomp      string         // SeccompDefault when empty, SeccompUnconfined or a JSON profile path
+	Ports        []PortMapping  // ports published on the host
+	Network      string         // network mode, bridge (none when rootless) when empty
+	Image        string         // image reference or ID, ./root_fs is used when empty
+	Log          LogConfig      // zero values take DefaultLogMaxSize and DefaultLogMaxFiles
+	TTY          bool           // run the binary on a pseudo-terminal, see AttachContainer
+	Init         bool           // keep a minimal init as PID 1 that runs the binary, forwards signals to it and reaps zombies
+	Output       io.Writer      // progress and warnings of the launch, os.Stdout when nil
+	// Copy the interpreter of a script from the host when the root filesystem lacks it
+	CopyInterpreter bool
 }
 
 var ContainersRunning = []Container{}
@@ -0,0 +1,335 @@
+package container
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Where the application binary is placed inside the container
+const containerBinaryPath = "/home/container/container-app"
+
+// Directories the dynamic loader searches after the ones from /etc/ld.so.conf
+var defaultLibraryDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// sharedObject is a file the binary needs at run time, with its location on the host and in the container
+type sharedObject struct {
+	hostPath      string
+	containerPath string
+}
+
+// UnresolvedLibrariesError lists the shared libraries of a binary that could not be found on the host
+type UnresolvedLibrariesError struct {
+	Binary    string
+	Libraries []string // as "libfoo.so.1 (needed by /usr/lib/libbar.so.2)"
+}
+
+func (e *UnresolvedLibrariesError) Error() string {
+	return fmt.Sprintf("cannot run %s, shared libraries not found on the host: %s", e.Binary, strings.Join(e.Libraries, ", "))
+}
+
+// binaryDependencies returns the dynamic loader and the shared libraries a binary needs, resolved the way the
+// host's loader would: RPATH, RUNPATH, the ld.so.conf directories and the default ones. Static binaries and
+// files that are not ELF binaries have none. containerPath is where the binary is placed in the container.
+func binaryDependencies(binary, containerPath string) ([]sharedObject, error) {
+	exe, err := elf.Open(binary)
+	if err != nil {
+		// Not an ELF binary, scripts are taken care of elsewhere
+		return nil, nil
+	}
+	defer exe.Close()
+
+	interp, err := elfInterpreter(exe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the interpreter of %s: %w", binary, err)
+	}
+	if interp == "" {
+		return nil, nil
+	}
+
+	resolver := &libraryResolver{
+		class:      exe.Class,
+		machine:    exe.Machine,
+		configDirs: ldSoConfDirs("/etc/ld.so.conf", map[string]bool{}),
+		found:      map[string]bool{},
+	}
+	objects := []sharedObject{{hostPath: interp, containerPath: interp}}
+
+	// Breadth first over the needed libraries, a library is only copied once
+	queue := []*elfObject{{path: binary, containerPath: containerPath, file: exe}}
+	// Libraries still queued when we return early are closed here, exe by its own defer
+	defer func() {
+		for _, object := range queue {
+			if object.file != exe {
+				object.file.Close()
+			}
+		}
+	}()
+	var unresolved []string
+	for len(queue) > 0 {
+		object := queue[0]
+		queue = queue[1:]
+
+		needed, err := object.file.ImportedLibraries()
+		if err != nil {
+			if object.file != exe {
+				object.file.Close()
+			}
+			return nil, fmt.Errorf("failed to read the libraries needed by %s: %w", object.path, err)
+		}
+		for _, name := range needed {
+			if resolver.found[name] {
+				continue
+			}
+			lib := resolver.resolve(name, object)
+			if lib == nil {
+				unresolved = append(unresolved, fmt.Sprintf("%s (needed by %s)", name, object.path))
+				resolver.found[name] = true
+				continue
+			}
+			resolver.found[name] = true
+			objects = append(objects, sharedObject{hostPath: lib.path, containerPath: lib.containerPath})
+			queue = append(queue, lib)
+		}
+		if object.file != exe {
+			object.file.Close()
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return nil, &UnresolvedLibrariesError{Binary: binary, Libraries: unresolved}
+	}
+	return objects, nil
+}
+
+// elfInterpreter returns the PT_INTERP of a binary, empty for static ones
+func elfInterpreter(f *elf.File) (string, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\x00"), nil
+	}
+	return "", nil
+}
+
+// elfObject is the executable or a shared library being resolved
+type elfObject struct {
+	path          string // on the host
+	containerPath string
+	file          *elf.File
+}
+
+type libraryResolver struct {
+	class      elf.Class
+	machine    elf.Machine
+	configDirs []string
+	found      map[string]bool // sonames already resolved
+}
+
+// searchDir is a directory a library is looked up in
+type searchDir struct {
+	path   string
+	origin bool // relative to the $ORIGIN of the object needing the library
+}
+
+// resolve finds a library needed by object, nil when it can't be found
+func (r *libraryResolver) resolve(name string, object *elfObject) *elfObject {
+	// A name with a slash is a path, relative ones are relative to the working directory
+	if strings.Contains(name, "/") {
+		return r.open(name, name)
+	}
+
+	rpath, _ := object.file.DynString(elf.DT_RPATH)
+	runpath, _ := object.file.DynString(elf.DT_RUNPATH)
+
+	var dirs []searchDir
+	// RPATH is ignored when the object has a RUNPATH
+	if len(runpath) == 0 {
+		dirs = append(dirs, r.expandSearchPath(rpath, object)...)
+	}
+	dirs = append(dirs, r.expandSearchPath(runpath, object)...)
+	for _, dir := range append(r.configDirs, defaultLibraryDirs...) {
+		dirs = append(dirs, searchDir{path: dir})
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir.path, name)
+
+		// Libraries found through $ORIGIN keep their place relative to the object in the container,
+		// the application itself lives somewhere else than on the host
+		containerPath := path
+		if dir.origin {
+			rel, err := filepath.Rel(filepath.Dir(object.path), path)
+			if err != nil {
+				continue
+			}
+			containerPath = filepath.Join(filepath.Dir(object.containerPath), rel)
+		}
+
+		if lib := r.open(path, containerPath); lib != nil {
+			return lib
+		}
+	}
+	return nil
+}
+
+// open returns the library at path if it is a shared object for the binary's architecture
+func (r *libraryResolver) open(path, containerPath string) *elfObject {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	if f.Class != r.class || f.Machine != r.machine {
+		f.Close()
+		return nil
+	}
+	return &elfObject{path: path, containerPath: filepath.Clean(containerPath), file: f}
+}
+
+// expandSearchPath splits RPATH/RUNPATH entries and substitutes $ORIGIN, $LIB and $PLATFORM
+func (r *libraryResolver) expandSearchPath(entries []string, object *elfObject) []searchDir {
+	libDir := "lib"
+	if r.class == elf.ELFCLASS64 {
+		libDir = "lib64"
+	}
+	platform := map[string]string{"amd64": "x86_64", "arm64": "aarch64", "386": "i686"}[runtime.GOARCH]
+	replacer := strings.NewReplacer(
+		"$ORIGIN", filepath.Dir(object.path), "${ORIGIN}", filepath.Dir(object.path),
+		"$LIB", libDir, "${LIB}", libDir,
+		"$PLATFORM", platform, "${PLATFORM}", platform,
+	)
+
+	var dirs []searchDir
+	for _, entry := range entries {
+		for _, dir := range strings.Split(entry, ":") {
+			if dir == "" {
+				continue
+			}
+			origin := strings.Contains(dir, "$ORIGIN") || strings.Contains(dir, "${ORIGIN}")
+			dirs = append(dirs, searchDir{path: replacer.Replace(dir), origin: origin})
+		}
+	}
+	return dirs
+}
+
+// ldSoConfDirs reads the library directories of an ld.so.conf file, following its includes
+func ldSoConfDirs(path string, seen map[string]bool) []string {
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "include" {
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					dirs = append(dirs, ldSoConfDirs(match, seen)...)
+				}
+			}
+			continue
+		}
+		dirs = append(dirs, fields...)
+	}
+	return dirs
+}
+
+// copyIntoContainer copies a host file into the container's root filesystem before it is started.
+// Symlinks of the root filesystem are followed within it, so /lib -> usr/lib style layouts are kept intact.
+func copyIntoContainer(c *Container, hostPath, containerPath string) error {
+	// Symlinks in the path come from the base root filesystem, an overlay's upper dir is still empty
+	base := c.RootfsLocation
+	if c.Storage == StorageOverlay {
+		base = c.LowerDir
+	}
+	resolvedDir, err := resolveInRootFollow(base, filepath.Dir(containerPath))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(base, resolvedDir)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(writableRootfs(c), rel, filepath.Base(containerPath))
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Replace whatever is there, a symlink must not redirect the write
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// Owned by container root when it is an unprivileged host user
+	if c.UserNS != nil && !Rootless {
+		uid, _ := mapToHost(0, c.UserNS.UIDMappings)
+		gid, _ := mapToHost(0, c.UserNS.GIDMappings)
+		return os.Chown(target, uid, gid)
+	}
+	return nil
+}
+
+// copyBinaryDependencies copies what the application needs to run, like its dynamic loader and shared
+// libraries, into the container
+func copyBinaryDependencies(c *Container, objects []sharedObject, out io.Writer) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(out, "Copying %d files needed to run the application into the container\n", len(objects))
+	for _, object := range objects {
+		if err := copyIntoContainer(c, object.hostPath, object.containerPath); err != nil {
+			return fmt.Errorf("failed to copy %s into the container: %w", object.hostPath, err)
+		}
+	}
+	return nil
+}
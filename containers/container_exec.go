@@ -0,0 +1,470 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// File descriptors of the exec helper, see ExecContainer
+const (
+	execConfigFD = 3 // execConfig as JSON
+	execStatusFD = 4 // initStatus messages back to the manager
+	execNSFD     = 5 // the namespaces to join in the order of execNamespaces, then the user namespace
+)
+
+// execNamespaces are joined in this order, the mount namespace last since it takes the host's filesystem away
+var execNamespaces = []struct {
+	name string // as in /proc/<pid>/ns
+	flag int
+}{
+	{"ipc", unix.CLONE_NEWIPC},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"cgroup", unix.CLONE_NEWCGROUP},
+	{"pid", unix.CLONE_NEWPID},
+	{"mnt", unix.CLONE_NEWNS},
+}
+
+// ExecOptions describes a command run in a running container by ExecContainer
+type ExecOptions struct {
+	Args        []string // the command, looked up in the container's PATH, then its arguments
+	Env         []string // NAME=value, or NAME to take the host's value, on top of the container's environment
+	WorkingDir  string   // the container's when empty
+	User        string   // user[:group] by name or ID, the container's when empty
+	TTY         bool     // run the command on a pseudo-terminal of its own
+	Interactive bool     // forward our input, stdin is /dev/null otherwise
+}
+
+// execConfig is what the exec helper needs to set the command up like the container's process
+type execConfig struct {
+	Hostname     string          `json:"hostname"`
+	Rootless     bool            `json:"rootless"`
+	Capabilities []string        `json:"capabilities"`
+	Seccomp      *SeccompProfile `json:"seccomp,omitempty"`
+	Process      ProcessSpec     `json:"process"`
+	Console      bool            `json:"console,omitempty"` // stdin, stdout and stderr are a pseudo-terminal to take as controlling terminal
+}
+
+// ExecContainer runs a command in the namespaces and cgroup of a running container, with its environment,
+// user, capabilities and seccomp profile, and returns its exit code. Our binary is re-executed as a helper
+// that joins the namespaces and starts the command as its child inside the container's PID namespace,
+// see RunExecInit.
+func ExecContainer(name string, opts ExecOptions) (int, error) {
+	if len(opts.Args) == 0 {
+		return 0, errors.New("no command to execute")
+	}
+	c := findContainer(name)
+	if c == nil {
+		return 0, fmt.Errorf("container '%s' not found", name)
+	}
+	target, err := openProcess(c.NamespacePID, c.StartTime)
+	if err != nil {
+		return 0, fmt.Errorf("container '%s' is not running", name)
+	}
+	defer target.Close()
+
+	process, err := execProcessSpec(*c, opts)
+	if err != nil {
+		return 0, err
+	}
+	config := execConfig{
+		Hostname:     c.Name,
+		Rootless:     Rootless,
+		Capabilities: c.Capabilities,
+		Process:      process,
+		Console:      opts.TTY,
+	}
+	if c.SeccompProfile != SeccompUnconfined {
+		if config.Seccomp, err = readSeccompProfile(filepath.Join(c.Location, seccompProfileFile)); err != nil {
+			return 0, fmt.Errorf("failed to read seccomp profile: %w", err)
+		}
+	}
+
+	namespaces, err := openNamespaces(target, c.UserNS != nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, ns := range namespaces {
+			ns.Close()
+		}
+	}()
+
+	configRead, configWrite, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create config pipe: %w", err)
+	}
+	defer configWrite.Close()
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		configRead.Close()
+		return 0, fmt.Errorf("failed to create status pipe: %w", err)
+	}
+	defer statusRead.Close()
+
+	cmd := exec.Command("/proc/self/exe", "exec-init")
+	cmd.ExtraFiles = append([]*os.File{configRead, statusWrite}, namespaces...)
+	cmd.Env = []string{}
+	if c.UserNS != nil {
+		// Joined before the Go runtime starts, see joinExecUserNamespace
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", execUserNSEnv, execNSFD+len(execNamespaces)))
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if opts.Interactive {
+		cmd.Stdin = os.Stdin
+	}
+
+	var console *console
+	if opts.TTY {
+		if console, err = openConsole(c.UserNS, os.Stdout); err != nil {
+			configRead.Close()
+			statusWrite.Close()
+			return 0, err
+		}
+		defer console.master.Close()
+		cmd.Stdin = console.slave
+		cmd.Stdout = console.slave
+		cmd.Stderr = console.slave
+	}
+
+	err = cmd.Start()
+	configRead.Close()
+	statusWrite.Close()
+	if console != nil {
+		console.slave.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the exec helper: %w", err)
+	}
+
+	abort := func(err error) (int, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+
+	// Into the container's cgroup before the command is started, its children inherit it
+	if c.CgroupPath != "" {
+		if err := addProcessToCgroup(c.CgroupPath, cmd.Process.Pid); err != nil {
+			return abort(err)
+		}
+	}
+	if err := json.NewEncoder(configWrite).Encode(config); err != nil {
+		return abort(fmt.Errorf("failed to send the configuration to the exec helper: %w", err))
+	}
+	configWrite.Close()
+
+	// The helper closes the pipe once the command is running
+	if err := readInitStatus(statusRead); err != nil {
+		var setupErr *SetupError
+		if errors.As(err, &setupErr) {
+			err = fmt.Errorf("exec failed at %s: %s", setupErr.Step, setupErr.Message)
+		} else {
+			err = errors.New("exec helper exited before starting the command")
+		}
+		return abort(err)
+	}
+
+	if console != nil {
+		return relayExecConsole(cmd, console.master, opts.Interactive)
+	}
+
+	// The command shares our terminal, ctrl-c is for it and we report how it took it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	return waitExec(cmd)
+}
+
+// execProcessSpec builds the process of an exec'd command from the container's and the options
+func execProcessSpec(c Container, opts ExecOptions) (ProcessSpec, error) {
+	process := c.Process
+	process.Args = opts.Args
+	process.Env = append([]string(nil), c.Process.Env...)
+	if !hasEnv(process.Env, "PATH") {
+		process.Env = append(process.Env, "PATH="+defaultPath)
+	}
+	for _, entry := range opts.Env {
+		entry, ok, err := resolveEnvEntry(entry)
+		if err != nil {
+			return ProcessSpec{}, err
+		}
+		if ok {
+			process.Env = mergeEnv(process.Env, entry)
+		}
+	}
+
+	if opts.WorkingDir != "" {
+		if !path.IsAbs(opts.WorkingDir) {
+			return ProcessSpec{}, fmt.Errorf("working directory %q is not an absolute path", opts.WorkingDir)
+		}
+		process.Cwd = path.Clean(opts.WorkingDir)
+	}
+	if process.Cwd == "" {
+		process.Cwd = "/"
+	}
+
+	if opts.User != "" {
+		if err := validateUserSpec(opts.User); err != nil {
+			return ProcessSpec{}, err
+		}
+		process.User = opts.User
+	}
+	return process, nil
+}
+
+// openNamespaces opens the namespaces of a container's init process in the order of execNamespaces,
+// followed by its user namespace when asked for
+func openNamespaces(target *processHandle, userNS bool) ([]*os.File, error) {
+	names := make([]string, 0, len(execNamespaces)+1)
+	for _, ns := range execNamespaces {
+		names = append(names, ns.name)
+	}
+	if userNS {
+		names = append(names, "user")
+	}
+
+	var files []*os.File
+	for _, name := range names {
+		file, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", target.pid, name))
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("failed to open %s namespace of the container: %w", name, err)
+		}
+		files = append(files, file)
+	}
+
+	// The PID could have been reused in the meantime
+	if !target.sameProcess() {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, errors.New("the container exited")
+	}
+	return files, nil
+}
+
+// relayExecConsole connects the user's terminal to the pseudo-terminal of an exec'd command until it exits
+func relayExecConsole(cmd *exec.Cmd, master *os.File, interactive bool) (int, error) {
+	stdin := int(os.Stdin.Fd())
+	if interactive && term.IsTerminal(stdin) {
+		if oldState, err := term.MakeRaw(stdin); err == nil {
+			defer term.Restore(stdin, oldState)
+		} else {
+			fmt.Printf("Warning: could not put the terminal in raw mode: %v\n", err)
+		}
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for range winch {
+			if size, err := terminalSize(); err == nil {
+				unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, size)
+			}
+		}
+	}()
+
+	// The master reads EIO once the command and whatever it left behind are gone
+	output := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, master)
+		close(output)
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if interactive {
+		go relayInput(stop, &detachFilter{}, func(_ byte, data []byte) error {
+			_, err := master.Write(data)
+			return err
+		})
+	}
+
+	code, err := waitExec(cmd)
+	select {
+	case <-output:
+	case <-time.After(2 * time.Second):
+	}
+	return code, err
+}
+
+// waitExec waits for the exec helper, which exits with the exit code of the command
+func waitExec(cmd *exec.Cmd) (int, error) {
+	cmd.Wait()
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, errors.New("unknown exit status of the exec helper")
+	}
+	return exitCode(status), nil
+}
+
+// RunExecInit is called when the binary is re-executed as the exec helper, in the container's user namespace
+// when it has one. It joins the other namespaces of the container and becomes a process of the container
+// like the end of RunContainerInit does: the same user, working directory, capabilities and seccomp filter.
+// The command is then started as its child, which lands in the container's PID namespace and inherits all
+// of that, and the helper exits with its exit code.
+func RunExecInit() {
+	initStatusPipe = os.NewFile(execStatusFD, "status")
+	// None of the inherited descriptors are for the command
+	for fd := execConfigFD; fd <= execNSFD+len(execNamespaces); fd++ {
+		unix.CloseOnExec(fd)
+	}
+
+	initStep = "reading the configuration"
+	var config execConfig
+	configPipe := os.NewFile(execConfigFD, "config")
+	if err := json.NewDecoder(configPipe).Decode(&config); err != nil {
+		fatal("invalid configuration: %v", err)
+	}
+	configPipe.Close()
+
+	initStep = "loading the seccomp profile"
+	var seccompFilter []unix.SockFilter
+	if config.Seccomp != nil {
+		var err error
+		if seccompFilter, err = compileSeccompProfile(config.Seccomp); err != nil {
+			fatal("failed to compile seccomp profile: %v", err)
+		}
+	}
+
+	// The mount namespace can only be changed by a thread that shares its root and working directory with no other
+	initStep = "joining the namespaces"
+	if err := joinedUserNamespace(); err != nil {
+		fatal("failed to join the user namespace: %v", err)
+	}
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		fatal("failed to unshare the filesystem attributes: %v", err)
+	}
+	for i, ns := range execNamespaces {
+		if err := unix.Setns(execNSFD+i, ns.flag); err != nil {
+			fatal("failed to join the %s namespace: %v", ns.name, err)
+		}
+		unix.Close(execNSFD + i)
+	}
+
+	initStep = "resolving the container user"
+	user, err := resolveUser(config.Process.User)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	initStep = "entering the working directory"
+	if err := os.MkdirAll(config.Process.Cwd, 0755); err != nil {
+		fatal("failed to create working directory: %v", err)
+	}
+	if err := os.Chdir(config.Process.Cwd); err != nil {
+		fatal("chdir to %s failed: %v", config.Process.Cwd, err)
+	}
+
+	env := config.Process.Env
+	if !hasEnv(env, "HOSTNAME") && config.Hostname != "" {
+		env = append(env, "HOSTNAME="+config.Hostname)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+user.Home)
+	}
+	initStep = "looking up the command"
+	binaryPath, err := lookPath(config.Process.Args[0], env)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	initStep = "applying capabilities"
+	if err := dropCapabilities(config.Capabilities); err != nil {
+		fatal("%v", err)
+	}
+
+	initStep = "switching to the container user"
+	if err := switchUser(user, config.Rootless); err != nil {
+		fatal("%v", err)
+	}
+
+	initStep = "applying capabilities"
+	if err := applyCapabilities(config.Capabilities, user.UID); err != nil {
+		fatal("%v", err)
+	}
+
+	initStep = "installing the seccomp filter"
+	if seccompFilter != nil {
+		if err := installSeccompFilter(seccompFilter); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	// Terminal signals reach the command directly, the others are passed on
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Forked from this thread, the command gets everything set up above
+	initStep = "executing the command"
+	cmd := exec.Command(binaryPath)
+	cmd.Args = config.Process.Args
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// A command on its own terminal gets its own session, like a login shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: config.Console, Setctty: config.Console}
+	if err := cmd.Start(); err != nil {
+		fatal("exec failed: %v", err)
+	}
+	reportStatus(initStatus{Ready: true})
+	initStatusPipe.Close()
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	cmd.Wait()
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		os.Exit(1)
+	}
+	os.Exit(exitCode(status))
+}
+
+// lookPath finds a command in the PATH of an environment like a shell does, names with a slash are taken as is
+func lookPath(name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+
+	var dirs string
+	for _, entry := range env {
+		if strings.HasPrefix(entry, "PATH=") {
+			dirs = strings.TrimPrefix(entry, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(dirs) {
+		if dir == "" {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: command not found", name)
+}
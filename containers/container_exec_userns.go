@@ -0,0 +1,46 @@
+//go:build cgo
+
+package container
+
+/*
+#define _GNU_SOURCE
+#include <errno.h>
+#include <sched.h>
+#include <stdlib.h>
+#include <unistd.h>
+
+static int exec_userns_errno = -1;
+
+// The kernel only lets a single threaded process join a user namespace, and a Go program has threads as
+// soon as its runtime starts. A constructor runs before that, in the exec helper it joins the namespace
+// passed by ExecContainer and leaves the outcome to joinedUserNamespace.
+__attribute__((constructor)) static void join_exec_userns(void) {
+	const char *fd = getenv("_MALPTAINER_EXEC_USERNS");
+	if (fd == NULL) {
+		return;
+	}
+	unsetenv("_MALPTAINER_EXEC_USERNS");
+
+	exec_userns_errno = setns(atoi(fd), CLONE_NEWUSER) < 0 ? errno : 0;
+	close(atoi(fd));
+}
+
+static int exec_userns_result(void) {
+	return exec_userns_errno;
+}
+*/
+import "C"
+
+import "syscall"
+
+// execUserNSEnv tells the exec helper which of its descriptors is the user namespace to join, the constructor
+// above reads it under the same name
+const execUserNSEnv = "_MALPTAINER_EXEC_USERNS"
+
+// joinedUserNamespace reports whether the exec helper joined its user namespace, when it was given one
+func joinedUserNamespace() error {
+	if errno := C.exec_userns_result(); errno > 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
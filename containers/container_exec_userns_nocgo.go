@@ -0,0 +1,20 @@
+//go:build !cgo
+
+package container
+
+import (
+	"errors"
+	"os"
+)
+
+// execUserNSEnv tells the exec helper which of its descriptors is the user namespace to join
+const execUserNSEnv = "_MALPTAINER_EXEC_USERNS"
+
+// joinedUserNamespace fails when the exec helper was given a user namespace: it has to be joined before
+// the Go runtime starts its threads, which takes the constructor of the cgo build
+func joinedUserNamespace() error {
+	if os.Getenv(execUserNSEnv) != "" {
+		return errors.New("malptainer was built without cgo, which exec needs for containers with a user namespace")
+	}
+	return nil
+}
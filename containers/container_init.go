@@ -1,46 +1,192 @@
 package container
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
+func init() {
+	// Namespaces created with unshare or joined with setns only apply to the calling thread, so the init
+	// process and the exec helper keep their main goroutine on the main thread all the way to the final exec
+	if len(os.Args) > 1 && (os.Args[1] == "init" || os.Args[1] == "exec-init") {
+		runtime.LockOSThread()
+	}
+}
+
+// File descriptors the init process inherits, see launchNamespaces
+const (
+	initConfigFD = 3 // InitConfig as JSON
+	initSyncFD   = 4 // a byte once the parent is done with the cgroup and the network
+	initStatusFD = 5 // initStatus messages back to the parent
+	initNetNSFD  = 6 // network namespace to join, container:<name> mode only
+)
+
 // InitConfig holds the configuration passed to the init process
 type InitConfig struct {
-	RootfsPath  string
-	ContainerDir string
-	BinaryPath  string
-	Hostname    string
+	RootfsPath   string      `json:"rootfs"`
+	Overlay      string      `json:"overlay,omitempty"` // overlay mount options, empty when the rootfs is a copy
+	ContainerDir string      `json:"container_dir"`
+	BinaryPath   string      `json:"binary"`
+	Hostname     string      `json:"hostname"`
+	UserNS       bool        `json:"userns"`
+	Rootless     bool        `json:"rootless"`
+	Capabilities []string    `json:"capabilities"`
+	SeccompPath  string      `json:"seccomp,omitempty"`
+	NetMode      string      `json:"network_mode"`
+	NetNSFD      int         `json:"network_ns_fd"`             // network namespace to join in container:<name> mode, -1 otherwise
+	NetPeer      string      `json:"network_peer,omitempty"`    // veth end moved into our network namespace, empty without bridge networking
+	NetAddress   string      `json:"network_address,omitempty"` // CIDR notation
+	NetGateway   string      `json:"network_gateway,omitempty"`
+	Process      ProcessSpec `json:"process"`
+	Console      string      `json:"console,omitempty"` // host path of the pseudo-terminal on stdin, stdout and stderr with -t
+	Init         bool        `json:"init,omitempty"`    // stay PID 1 and run the binary as our child, see runAsInit
+}
+
+// initStatus is sent by the init process over the status pipe: Ready right before the exec of the application,
+// or the setup step that failed
+type initStatus struct {
+	Ready bool   `json:"ready,omitempty"`
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SetupError is a failed step of the container setup, as reported by the init process
+type SetupError struct {
+	Step    string
+	Message string
+}
+
+func (e *SetupError) Error() string {
+	return fmt.Sprintf("container setup failed at %s: %s", e.Step, e.Message)
+}
+
+var (
+	// The status pipe of the init process, and the step it is at for error reports
+	initStatusPipe *os.File
+	initStep       string
+)
+
+// readInitStatus reads the status pipe of an init process until the exec of the application closes it
+func readInitStatus(pipe *os.File) error {
+	decoder := json.NewDecoder(pipe)
+	ready := false
+	for {
+		var status initStatus
+		err := decoder.Decode(&status)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid status from the container init process: %w", err)
+		}
+		if status.Error != "" {
+			return &SetupError{Step: status.Step, Message: status.Error}
+		}
+		ready = status.Ready
+	}
+
+	if !ready {
+		return errors.New("container init process exited before finishing the setup")
+	}
+	return nil
+}
+
+// reportStatus sends a status message to the parent, if it is listening
+func reportStatus(status initStatus) {
+	if initStatusPipe != nil {
+		json.NewEncoder(initStatusPipe).Encode(status)
+	}
 }
 
 // RunContainerInit is called when the binary is re-executed as the container init process
 // This runs INSIDE the new namespaces and sets up the container environment
 func RunContainerInit() {
-	// Read config from environment variables (set by parent)
-	config := InitConfig{
-		RootfsPath:   os.Getenv("CNTR_ROOTFS"),
-		ContainerDir: os.Getenv("CNTR_DIR"),
-		BinaryPath:   os.Getenv("CNTR_BINARY"),
-		Hostname:     os.Getenv("CNTR_HOSTNAME"),
+	// Report back on the status pipe, the exec of the application closes it
+	initStatusPipe = os.NewFile(initStatusFD, "status")
+	unix.CloseOnExec(initStatusFD)
+
+	// Read the config from its pipe (written by the parent)
+	initStep = "reading the configuration"
+	var config InitConfig
+	configPipe := os.NewFile(initConfigFD, "config")
+	if err := json.NewDecoder(configPipe).Decode(&config); err != nil {
+		fatal("invalid configuration: %v", err)
 	}
-
+	configPipe.Close()
 	if config.RootfsPath == "" {
-		fatal("CNTR_ROOTFS not set")
+		fatal("no rootfs in the configuration")
+	}
+	if config.NetNSFD >= 0 {
+		unix.CloseOnExec(config.NetNSFD)
+	}
+
+	// Compile the seccomp filter while the profile in the container directory is still reachable
+	initStep = "loading the seccomp profile"
+	var seccompFilter []unix.SockFilter
+	if config.SeccompPath != "" {
+		profile, err := readSeccompProfile(config.SeccompPath)
+		if err != nil {
+			fatal("failed to read seccomp profile: %v", err)
+		}
+		if seccompFilter, err = compileSeccompProfile(profile); err != nil {
+			fatal("failed to compile seccomp profile: %v", err)
+		}
+	}
+
+	// Wait for the parent to place us in the container's cgroup and hand us our veth
+	initStep = "waiting for the parent"
+	waitForParent(initSyncFD)
+
+	// Create the cgroup namespace now, so its root is the container's own cgroup
+	initStep = "creating the cgroup namespace"
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		fatal("failed to create cgroup namespace: %v", err)
+	}
+
+	// Join the network of another container, or bring up our own: the loopback, and eth0 when attached to the bridge
+	initStep = "setting up the network"
+	switch {
+	case config.NetNSFD >= 0:
+		if err := joinNetworkNamespace(config.NetNSFD); err != nil {
+			fatal("%v", err)
+		}
+	case config.NetMode != NetworkHost:
+		if err := configureContainerNetwork(config.NetPeer, config.NetAddress, config.NetGateway); err != nil {
+			fatal("failed to configure network: %v", err)
+		}
+	}
+
+	// Take the terminal of a -t container as controlling terminal, startInit made us a session leader
+	if config.Console != "" {
+		initStep = "setting up the console"
+		if err := unix.IoctlSetInt(0, unix.TIOCSCTTY, 0); err != nil {
+			fatal("failed to set the controlling terminal: %v", err)
+		}
 	}
 
 	fmt.Println("Container init: starting setup...")
 
+	initStep = "mounting the root filesystem"
+
 	// 1. Change root mount propagation to slave recursively
 	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
 		fatal("failed to make root rslave: %v", err)
 	}
 
-	// 2. Recursive bind mount the rootfs to itself (required for pivot_root)
-	if err := unix.Mount(config.RootfsPath, config.RootfsPath, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+	// 2. Mount the overlay on the rootfs, or recursive bind mount the copied rootfs to itself (required for pivot_root)
+	if config.Overlay != "" {
+		if err := unix.Mount("overlay", config.RootfsPath, "overlay", 0, config.Overlay); err != nil {
+			fatal("failed to mount overlay rootfs: %v", err)
+		}
+	} else if err := unix.Mount(config.RootfsPath, config.RootfsPath, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
 		fatal("failed to bind mount rootfs: %v", err)
 	}
 
@@ -50,6 +196,7 @@ func RunContainerInit() {
 	}
 
 	// 4. Create and mount /proc
+	initStep = "mounting /proc, /dev and /sys"
 	procPath := filepath.Join(config.RootfsPath, "proc")
 	os.MkdirAll(procPath, 0755)
 	if err := unix.Mount("proc", procPath, "proc", 0, ""); err != nil {
@@ -63,8 +210,8 @@ func RunContainerInit() {
 		fatal("failed to mount dev tmpfs: %v", err)
 	}
 
-	// 6. Create device nodes
-	createDeviceNodes(devPath)
+	// 6. Create device nodes, mknod is not allowed inside a user namespace so bind mount the host's instead
+	createDeviceNodes(devPath, config.UserNS)
 
 	// 7. Create symlinks
 	createDevSymlinks(devPath)
@@ -77,26 +224,42 @@ func RunContainerInit() {
 	}
 	os.Symlink("/dev/pts/ptmx", filepath.Join(devPath, "ptmx"))
 
+	// The terminal of a -t container lives in the host's devpts, bind mount it as /dev/console
+	if config.Console != "" {
+		consolePath := filepath.Join(devPath, "console")
+		if file, err := os.OpenFile(consolePath, os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+			file.Close()
+		}
+		if err := unix.Mount(config.Console, consolePath, "", unix.MS_BIND, ""); err != nil {
+			fatal("failed to bind mount /dev/console: %v", err)
+		}
+	}
+
 	// 9. Create and mount /dev/mqueue
 	mqueuePath := filepath.Join(devPath, "mqueue")
 	os.MkdirAll(mqueuePath, 0755)
 	if err := unix.Mount("mqueue", mqueuePath, "mqueue", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
 		// mqueue might not be available, ignore error
-		fmt.Printf("Warning: failed to mount mqueue: %v\n", err)
+		warnMount(config, "mqueue", err)
 	}
 
 	// 10. Create and mount /dev/shm
 	shmPath := filepath.Join(devPath, "shm")
 	os.MkdirAll(shmPath, 0755)
 	if err := unix.Mount("tmpfs", shmPath, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=1777,size=67108864"); err != nil {
-		fatal("failed to mount shm: %v", err)
+		rootlessMountError(config, "/dev/shm", err)
 	}
 
 	// 11. Create and mount /sys (read-only)
 	sysPath := filepath.Join(config.RootfsPath, "sys")
 	os.MkdirAll(sysPath, 0755)
 	if err := unix.Mount("sysfs", sysPath, "sysfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
-		fatal("failed to mount sysfs: %v", err)
+		rootlessMountError(config, "sysfs", err)
+
+		// A fresh sysfs needs to own the network namespace, fall back to the host's /sys
+		if err := unix.Mount("/sys", sysPath, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			fmt.Printf("Container init: rootless: could not bind mount the host's /sys either: %v\n", err)
+		}
 	}
 
 	// 12. Create and mount /sys/fs/cgroup (read-only)
@@ -104,13 +267,14 @@ func RunContainerInit() {
 	os.MkdirAll(cgroupPath, 0755)
 	if err := unix.Mount("cgroup2", cgroupPath, "cgroup2", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
 		// cgroup2 might not be available, try to continue
-		fmt.Printf("Warning: failed to mount cgroup2: %v\n", err)
+		warnMount(config, "cgroup2", err)
 	}
 
 	// 13. Bind mount /etc/hostname, /etc/hosts, /etc/resolv.conf
 	bindMountNetworkFiles(config.RootfsPath, config.ContainerDir)
 
 	// 14. Pivot root
+	initStep = "pivot_root"
 	oldRoot := filepath.Join(config.RootfsPath, ".oldroot")
 	os.MkdirAll(oldRoot, 0755)
 
@@ -137,6 +301,7 @@ func RunContainerInit() {
 	os.RemoveAll("/.oldroot")
 
 	// 19. Set hostname
+	initStep = "hardening the container"
 	if config.Hostname != "" {
 		if err := unix.Sethostname([]byte(config.Hostname)); err != nil {
 			fmt.Printf("Warning: failed to set hostname: %v\n", err)
@@ -144,20 +309,84 @@ func RunContainerInit() {
 	}
 
 	// 20. Harden /proc - make sensitive directories read-only
-	hardenProc()
+	hardenProc(config)
 
 	// 21. Mask sensitive paths
-	maskSensitivePaths()
+	maskSensitivePaths(config)
+
+	// 22. Resolve the container's user, now that its /etc/passwd and /etc/group are in place
+	initStep = "resolving the container user"
+	user, err := resolveUser(config.Process.User)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	// 23. Enter the working directory, creating it when the rootfs lacks it
+	initStep = "entering the working directory"
+	if err := os.MkdirAll(config.Process.Cwd, 0755); err != nil {
+		fatal("failed to create working directory: %v", err)
+	}
+	if err := os.Chdir(config.Process.Cwd); err != nil {
+		fatal("chdir to %s failed: %v", config.Process.Cwd, err)
+	}
+
+	// 24. Drop the capabilities outside the container's set, while still allowed to
+	initStep = "applying capabilities"
+	if err := dropCapabilities(config.Capabilities); err != nil {
+		fatal("%v", err)
+	}
+
+	// 25. Switch to the container's user and give root its capabilities back, nobody else gets any
+	initStep = "switching to the container user"
+	if err := switchUser(user, config.Rootless); err != nil {
+		fatal("%v", err)
+	}
+	initStep = "applying capabilities"
+	if err := applyCapabilities(config.Capabilities, user.UID); err != nil {
+		fatal("%v", err)
+	}
 
 	fmt.Println("Container init: setup complete, executing application...")
 
-	// 22. Finally, exec the container binary
-	if err := syscall.Exec(config.BinaryPath, []string{config.BinaryPath}, os.Environ()); err != nil {
+	// 26. Install the seccomp filter, the last thing before the exec so the setup is not filtered
+	initStep = "installing the seccomp filter"
+	if seccompFilter != nil {
+		if err := installSeccompFilter(seccompFilter); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	// 27. Finally, exec the container binary with its own environment, HOME and HOSTNAME default to the user's and the container's
+	env := config.Process.Env
+	if !hasEnv(env, "HOSTNAME") && config.Hostname != "" {
+		env = append(env, "HOSTNAME="+config.Hostname)
+	}
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+user.Home)
+	}
+	// With --init we stay PID 1 instead, forwarding signals to it and reaping zombies
+	initStep = "executing the application"
+	if config.Init {
+		runAsInit(config.BinaryPath, config.Process.Args, env, config.Console != "")
+	}
+	reportStatus(initStatus{Ready: true})
+	if err := syscall.Exec(config.BinaryPath, config.Process.Args, env); err != nil {
 		fatal("exec failed: %v", err)
 	}
 }
 
-func createDeviceNodes(devPath string) {
+// waitForParent blocks until the parent writes to (or closes) the sync pipe
+func waitForParent(fd int) {
+	syncPipe := os.NewFile(uintptr(fd), "sync")
+	defer syncPipe.Close()
+
+	buf := make([]byte, 1)
+	if n, err := syncPipe.Read(buf); n != 1 {
+		fatal("parent aborted the setup: %v", err)
+	}
+}
+
+func createDeviceNodes(devPath string, bindHostDevices bool) {
 	// Device nodes: name, mode, major, minor
 	devices := []struct {
 		name  string
@@ -175,6 +404,12 @@ func createDeviceNodes(devPath string) {
 
 	for _, dev := range devices {
 		path := filepath.Join(devPath, dev.name)
+
+		if bindHostDevices {
+			bindMountHostDevice(dev.name, path)
+			continue
+		}
+
 		devNum := unix.Mkdev(dev.major, dev.minor)
 		if err := unix.Mknod(path, unix.S_IFCHR|dev.mode, int(devNum)); err != nil {
 			fmt.Printf("Warning: failed to create %s: %v\n", dev.name, err)
@@ -183,6 +418,20 @@ func createDeviceNodes(devPath string) {
 	}
 }
 
+// bindMountHostDevice bind mounts /dev/<name> of the host onto an empty file at path
+func bindMountHostDevice(name, path string) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Printf("Warning: failed to create %s: %v\n", name, err)
+		return
+	}
+	file.Close()
+
+	if err := unix.Mount(filepath.Join("/dev", name), path, "", unix.MS_BIND, ""); err != nil {
+		fmt.Printf("Warning: failed to bind mount %s: %v\n", name, err)
+	}
+}
+
 func createDevSymlinks(devPath string) {
 	symlinks := []struct {
 		target string
@@ -220,7 +469,7 @@ func bindMountNetworkFiles(rootfsPath, containerDir string) {
 	}
 }
 
-func hardenProc() {
+func hardenProc(config InitConfig) {
 	dirs := []string{"bus", "fs", "irq", "sys", "sysrq-trigger"}
 
 	for _, d := range dirs {
@@ -228,12 +477,14 @@ func hardenProc() {
 		if _, err := os.Stat(path); err == nil {
 			// Bind mount to itself, then remount read-only
 			unix.Mount(path, path, "", unix.MS_BIND, "")
-			unix.Mount("", path, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, "")
+			if err := unix.Mount("", path, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil && config.Rootless {
+				fmt.Printf("Container init: rootless: %s stays writable, read-only remount refused: %v\n", path, err)
+			}
 		}
 	}
 }
 
-func maskSensitivePaths() {
+func maskSensitivePaths(config InitConfig) {
 	paths := []string{
 		"/proc/asound",
 		"/proc/interrupts",
@@ -256,16 +507,41 @@ func maskSensitivePaths() {
 
 		if info.IsDir() {
 			// Mask directory with read-only tmpfs
-			unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "")
+			err = unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "")
 		} else {
 			// Mask file by bind mounting /dev/null
-			unix.Mount("/dev/null", p, "", unix.MS_BIND, "")
+			err = unix.Mount("/dev/null", p, "", unix.MS_BIND, "")
 		}
+		if err != nil && config.Rootless {
+			fmt.Printf("Container init: rootless: could not mask %s: %v\n", p, err)
+		}
+	}
+}
+
+// rootlessMountError handles a failed mount the container needs. In rootless mode, mounts the kernel
+// refuses to an unprivileged user namespace are skipped with a diagnostic instead of aborting the setup.
+func rootlessMountError(config InitConfig, what string, err error) {
+	if config.Rootless && (errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)) {
+		fmt.Printf("Container init: rootless: skipping %s mount, the kernel does not allow it for unprivileged users (%v)\n", what, err)
+		return
+	}
+	fatal("failed to mount %s: %v", what, err)
+}
+
+// warnMount reports a failed optional mount
+func warnMount(config InitConfig, what string, err error) {
+	if config.Rootless && (errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)) {
+		fmt.Printf("Container init: rootless: skipping %s mount, the kernel does not allow it for unprivileged users (%v)\n", what, err)
+		return
 	}
+	fmt.Printf("Warning: failed to mount %s: %v\n", what, err)
 }
 
+// fatal reports the failed setup step to the parent and exits
 func fatal(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "Container init error: "+format+"\n", args...)
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "Container init error: %s\n", message)
+	reportStatus(initStatus{Step: initStep, Error: message})
 	os.Exit(1)
 }
 
@@ -0,0 +1,435 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFileName = "container.log"
+
+	DefaultLogMaxSize  = 10 << 20 // bytes
+	DefaultLogMaxFiles = 3
+
+	// Longer lines are split into several entries
+	maxLogLine = 16 << 10
+	// How often a followed log is checked for new output
+	logFollowInterval = 250 * time.Millisecond
+)
+
+// Streams of a log entry
+const (
+	logStdout = "stdout"
+	logStderr = "stderr"
+)
+
+// LogConfig sets how much of a container's output is kept
+type LogConfig struct {
+	MaxSize  int64 `json:"max_size"`  // size in bytes a log file may reach before it is rotated
+	MaxFiles int   `json:"max_files"` // number of files kept, the current one included
+}
+
+// logEntry is a line of a container's output, stored as a line of JSON in its log file
+type logEntry struct {
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+	Line   string    `json:"line"` // without the newline
+	// Not terminated by a newline: the line was too long for one entry or the output ended mid-line
+	Partial bool `json:"partial,omitempty"`
+}
+
+// LogOptions selects the output printed by ContainerLogs
+type LogOptions struct {
+	Follow     bool      // keep printing new output until the container exits
+	Tail       int       // only print the last lines, every line when negative
+	Since      time.Time // only print output written from then on, when set
+	Timestamps bool      // prefix every line with the time it was written
+}
+
+// validateLogConfig fills in the defaults of a log configuration
+func validateLogConfig(config LogConfig) (LogConfig, error) {
+	if config.MaxSize < 0 || config.MaxFiles < 0 {
+		return config, fmt.Errorf("log size and file count must be positive")
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = DefaultLogMaxSize
+	}
+	if config.MaxFiles == 0 {
+		config.MaxFiles = DefaultLogMaxFiles
+	}
+	return config, nil
+}
+
+// logFilePath returns the path of a container's log file, the rotated ones are numbered from 1 (the newest)
+func logFilePath(containerDir string, index int) string {
+	path := filepath.Join(containerDir, logFileName)
+	if index > 0 {
+		path = fmt.Sprintf("%s.%d", path, index)
+	}
+	return path
+}
+
+// logWriter appends entries to a container's log file and rotates it once it grows past the maximum size
+type logWriter struct {
+	mu           sync.Mutex
+	containerDir string
+	config       LogConfig
+	file         *os.File // nil once the log can't be written anymore
+	size         int64
+}
+
+func openLogWriter(containerDir string, config LogConfig) (*logWriter, error) {
+	w := &logWriter{containerDir: containerDir, config: config}
+	if err := w.open(); err != nil {
+		return nil, fmt.Errorf("failed to open container log: %w", err)
+	}
+	return w, nil
+}
+
+func (w *logWriter) open() error {
+	file, err := os.OpenFile(logFilePath(w.containerDir, 0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// write appends an entry in a single write, so a reader never sees half of it
+func (w *logWriter) write(entry logEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil && w.size > 0 && w.size+int64(len(data)) > w.config.MaxSize {
+		w.rotate()
+	}
+	if w.file == nil {
+		return
+	}
+	n, _ := w.file.Write(data)
+	w.size += int64(n)
+}
+
+// rotate renames container.log to container.log.1, container.log.1 to container.log.2 and so on,
+// the oldest file is overwritten. When the new file can't be created the output is dropped.
+func (w *logWriter) rotate() {
+	w.file.Close()
+	w.file = nil
+
+	if w.config.MaxFiles <= 1 {
+		os.Remove(logFilePath(w.containerDir, 0))
+	}
+	for i := w.config.MaxFiles - 1; i > 0; i-- {
+		os.Rename(logFilePath(w.containerDir, i-1), logFilePath(w.containerDir, i))
+	}
+	w.open()
+}
+
+func (w *logWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// capture writes what is read from a stream to the log line by line, until the stream is closed.
+// A terminal ends its lines with \r\n, the \r is dropped as well.
+func (w *logWriter) capture(stream string, r io.Reader) {
+	reader := bufio.NewReaderSize(r, maxLogLine)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			entry := logEntry{Stream: stream, Time: time.Now().UTC()}
+			if line[len(line)-1] == '\n' {
+				entry.Line = strings.TrimSuffix(string(line[:len(line)-1]), "\r")
+			} else {
+				entry.Line = string(line)
+				entry.Partial = true
+			}
+			w.write(entry)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// outputCapture collects the output of a container's processes into its log and sends it to the attached clients.
+// It runs in the monitor, the init process gets the write ends of its pipes, or the terminal with -t.
+type outputCapture struct {
+	stdout *os.File
+	stderr *os.File
+	log    *logWriter
+	attach *attachServer
+	done   sync.WaitGroup
+}
+
+// captureOutput opens a container's log and starts copying the output of the container into it.
+// With -t that is what it writes to its terminal, logged as stdout.
+func captureOutput(c Container, master *os.File, attach *attachServer) (*outputCapture, error) {
+	log, err := openLogWriter(c.Location, c.Log)
+	if err != nil {
+		return nil, err
+	}
+	output := &outputCapture{log: log, attach: attach}
+
+	if master != nil {
+		output.copy(logStdout, master)
+		return output, nil
+	}
+
+	for _, stream := range []string{logStdout, logStderr} {
+		read, write, err := os.Pipe()
+		if err != nil {
+			output.closeWriters()
+			log.Close()
+			return nil, fmt.Errorf("failed to create %s pipe: %w", stream, err)
+		}
+		if stream == logStdout {
+			output.stdout = write
+		} else {
+			output.stderr = write
+		}
+		output.copy(stream, read)
+	}
+	return output, nil
+}
+
+// copy passes what the container writes to a stream on to the attached clients as it comes,
+// and to the log line by line. The stream is closed at the end, a terminal's master reads EIO then.
+func (o *outputCapture) copy(stream string, r *os.File) {
+	kind := byte(frameStdout)
+	if stream == logStderr {
+		kind = frameStderr
+	}
+
+	lines, linesWrite := io.Pipe()
+	o.done.Add(2)
+	go func() {
+		defer o.done.Done()
+		o.log.capture(stream, lines)
+	}()
+	go func() {
+		defer o.done.Done()
+		defer r.Close()
+		defer linesWrite.Close()
+
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				o.attach.broadcast(kind, buf[:n])
+				linesWrite.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// closeWriters closes the monitor's own write ends, once the init process has been started with them
+func (o *outputCapture) closeWriters() {
+	for _, f := range []*os.File{o.stdout, o.stderr} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// wait gives the capture the time to write the last output to the log, which is complete once the last
+// process of the container is gone. A process that got hold of the pipes outside of it can't hold up the exit
+// for longer than the timeout.
+func (o *outputCapture) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		o.done.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	o.log.Close()
+}
+
+// logReader reads the entries of a log file as they are appended
+type logReader struct {
+	file    *os.File
+	pending []byte // the start of a line still being written
+}
+
+// next returns the entries written since the last call, malformed lines are skipped
+func (r *logReader) next() []logEntry {
+	data, err := io.ReadAll(r.file)
+	if err != nil && len(data) == 0 {
+		return nil
+	}
+	data = append(r.pending, data...)
+
+	var entries []logEntry
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		var entry logEntry
+		if err := json.Unmarshal(data[:end], &entry); err == nil {
+			entries = append(entries, entry)
+		}
+		data = data[end+1:]
+	}
+	r.pending = append([]byte(nil), data...)
+	return entries
+}
+
+// rotated reports whether the log file has been rotated away from under the reader
+func (r *logReader) rotated(path string) bool {
+	current, err := os.Stat(path)
+	if err != nil {
+		// Between the rename and the creation of the new file
+		return false
+	}
+	open, err := r.file.Stat()
+	return err == nil && !os.SameFile(open, current)
+}
+
+// readLogFile returns every entry of a log file, none for a missing one
+func readLogFile(path string) []logEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return (&logReader{file: file}).next()
+}
+
+// ContainerLogs prints the output of a container, what it wrote to stdout on stdout and stderr on stderr
+func ContainerLogs(name string, opts LogOptions) error {
+	c := findContainer(name)
+	if c == nil {
+		return fmt.Errorf("container '%s' not found", name)
+	}
+
+	// Followed until the monitor is gone, it exits once the whole output is in the log
+	var monitor *processHandle
+	if opts.Follow {
+		if m, err := openProcess(c.MonitorPID, c.MonitorStartTime); err == nil {
+			monitor = m
+			defer monitor.Close()
+		}
+	}
+
+	// Oldest first: the rotated files from the highest number down, then the current one
+	var entries []logEntry
+	rotated := 0
+	for {
+		if _, err := os.Stat(logFilePath(c.Location, rotated+1)); err != nil {
+			break
+		}
+		rotated++
+	}
+	for i := rotated; i > 0; i-- {
+		entries = append(entries, readLogFile(logFilePath(c.Location, i))...)
+	}
+
+	path := logFilePath(c.Location, 0)
+	var reader *logReader
+	if file, err := os.Open(path); err == nil {
+		reader = &logReader{file: file}
+		defer func() { reader.file.Close() }()
+		entries = append(entries, reader.next()...)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read container log: %w", err)
+	}
+
+	if !opts.Since.IsZero() {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !entry.Time.Before(opts.Since) {
+				kept = append(kept, entry)
+			}
+		}
+		entries = kept
+	}
+	if opts.Tail >= 0 && len(entries) > opts.Tail {
+		entries = entries[len(entries)-opts.Tail:]
+	}
+	for _, entry := range entries {
+		printLogEntry(entry, opts.Timestamps)
+	}
+
+	for monitor != nil {
+		running := monitor.alive()
+
+		if reader == nil {
+			if file, err := os.Open(path); err == nil {
+				reader = &logReader{file: file}
+				defer func() { reader.file.Close() }()
+			}
+		}
+		if reader != nil {
+			for _, entry := range reader.next() {
+				printLogEntry(entry, opts.Timestamps)
+			}
+			// Finish the rotated file, it may have been written to since, and carry on with the new one
+			if reader.rotated(path) {
+				if file, err := os.Open(path); err == nil {
+					for _, entry := range reader.next() {
+						printLogEntry(entry, opts.Timestamps)
+					}
+					reader.file.Close()
+					reader.file = file
+					reader.pending = nil
+					continue
+				}
+			}
+		}
+
+		// Checked before the last read, so the output written right before the exit is printed as well
+		if !running {
+			return nil
+		}
+		time.Sleep(logFollowInterval)
+	}
+	return nil
+}
+
+// printLogEntry prints an entry on the stream it was written to
+func printLogEntry(entry logEntry, timestamps bool) {
+	out := os.Stdout
+	if entry.Stream == logStderr {
+		out = os.Stderr
+	}
+
+	line := entry.Line
+	if !entry.Partial {
+		line += "\n"
+	}
+	if timestamps {
+		line = entry.Time.Format(time.RFC3339Nano) + " " + line
+	}
+	io.WriteString(out, line)
+}
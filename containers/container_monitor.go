@@ -0,0 +1,245 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// File descriptors the monitor process inherits, see startMonitor
+const (
+	monitorRequestFD = 3 // monitorRequest as JSON, closed by the manager once the container is saved as running
+	monitorResultFD  = 4 // a monitorResult back to the manager
+	monitorNetNSFD   = 5 // network namespace to join, container:<name> mode only
+	monitorConsoleFD = 6 // slave of the pseudo-terminal, -t only
+	monitorMasterFD  = 7 // and its master
+)
+
+// monitorRequest is what the manager hands a new monitor process
+type monitorRequest struct {
+	Container Container  `json:"container"`
+	Config    InitConfig `json:"config"`
+}
+
+// monitorResult tells the manager whether the init process got to exec the application
+type monitorResult struct {
+	PID       int    `json:"pid,omitempty"`
+	StartTime uint64 `json:"start_time,omitempty"`
+	Step      string `json:"step,omitempty"` // the setup step that failed, for a SetupError
+	Error     string `json:"error,omitempty"`
+}
+
+// startMonitor starts the monitor of a container, which starts the init process as its child and waits
+// for it. The returned function lets the monitor record the exit, call it once the container is saved.
+func startMonitor(container *Container, config InitConfig, netNS *os.File, console *console) (func(), error) {
+	requestRead, requestWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create monitor pipe: %w", err)
+	}
+	resultRead, resultWrite, err := os.Pipe()
+	if err != nil {
+		requestRead.Close()
+		requestWrite.Close()
+		return nil, fmt.Errorf("failed to create monitor pipe: %w", err)
+	}
+	defer resultRead.Close()
+
+	// In its own session, so it outlives the manager and the terminal it runs in
+	cmd := exec.Command("/proc/self/exe", "monitor")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{requestRead, resultWrite} // fd 3 and 4 in the monitor
+	// A nil file leaves its descriptor closed
+	cmd.ExtraFiles = append(cmd.ExtraFiles, netNS)
+	if console != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, console.slave, console.master)
+	}
+	err = cmd.Start()
+	requestRead.Close()
+	resultWrite.Close()
+	if err != nil {
+		requestWrite.Close()
+		return nil, fmt.Errorf("failed to start container monitor: %w", err)
+	}
+	// Reap it in case the manager outlives the container
+	go cmd.Wait()
+
+	if err := json.NewEncoder(requestWrite).Encode(monitorRequest{Container: *container, Config: config}); err != nil {
+		requestWrite.Close()
+		return nil, fmt.Errorf("failed to send the container to its monitor: %w", err)
+	}
+
+	var result monitorResult
+	if err := json.NewDecoder(resultRead).Decode(&result); err != nil {
+		requestWrite.Close()
+		return nil, fmt.Errorf("container monitor exited before starting the container: %w", err)
+	}
+	if result.Error != "" {
+		requestWrite.Close()
+		if result.Step != "" {
+			return nil, &SetupError{Step: result.Step, Message: result.Error}
+		}
+		return nil, errors.New(result.Error)
+	}
+
+	// Store the PID of the namespace process, and its start time to detect PID reuse later on
+	container.NamespacePID = result.PID
+	container.StartTime = result.StartTime
+	container.MonitorPID = cmd.Process.Pid
+	if startTime, err := processStartTime(cmd.Process.Pid); err == nil {
+		container.MonitorStartTime = startTime
+	}
+	return func() { requestWrite.Close() }, nil
+}
+
+// RunContainerMonitor is called when the binary is re-executed as the monitor of a container.
+// It starts the init process, reports back to the manager, then waits for the container to exit
+// and records its exit status in the state file. Meanwhile it writes the container's output to its log
+// and serves the console socket clients attach through.
+func RunContainerMonitor() {
+	requestPipe := os.NewFile(monitorRequestFD, "request")
+	resultPipe := os.NewFile(monitorResultFD, "result")
+
+	report := func(result monitorResult) {
+		json.NewEncoder(resultPipe).Encode(result)
+		resultPipe.Close()
+	}
+
+	var request monitorRequest
+	if err := json.NewDecoder(requestPipe).Decode(&request); err != nil {
+		report(monitorResult{Error: fmt.Sprintf("invalid monitor request: %v", err)})
+		os.Exit(1)
+	}
+
+	// With -t we keep the master end of the terminal, the init process gets the slave
+	var slave, master *os.File
+	if request.Config.Console != "" {
+		slave = os.NewFile(monitorConsoleFD, "console")
+		master = os.NewFile(monitorMasterFD, "console-master")
+	}
+
+	// Everything the container prints goes to its log, and to the clients attached to it
+	attach, err := listenAttach(request.Container, master)
+	if err != nil {
+		report(monitorResult{Error: err.Error()})
+		os.Exit(1)
+	}
+	output, err := captureOutput(request.Container, master, attach)
+	if err != nil {
+		attach.Close()
+		report(monitorResult{Error: err.Error()})
+		os.Exit(1)
+	}
+
+	var netNS *os.File
+	if request.Config.NetNSFD >= 0 {
+		netNS = os.NewFile(monitorNetNSFD, "netns")
+	}
+	cmd, err := startInit(request.Container, request.Config, netNS, slave, output)
+	if netNS != nil {
+		netNS.Close()
+	}
+	// The master reads EIO once the init process and its children are gone, as long as nobody else holds the slave
+	if slave != nil {
+		slave.Close()
+	}
+	output.closeWriters()
+	if err != nil {
+		attach.Close()
+		result := monitorResult{Error: err.Error()}
+		var setupErr *SetupError
+		if errors.As(err, &setupErr) {
+			result = monitorResult{Step: setupErr.Step, Error: setupErr.Message}
+		}
+		report(result)
+		os.Exit(1)
+	}
+
+	result := monitorResult{PID: cmd.Process.Pid}
+	if startTime, err := processStartTime(cmd.Process.Pid); err == nil {
+		result.StartTime = startTime
+	}
+	report(result)
+
+	// The manager saves the container as running first, or dies trying
+	io.Copy(io.Discard, requestPipe)
+
+	cmd.Wait()
+	output.wait(2 * time.Second)
+	attach.Close()
+	recordExit(request.Container.Location, cmd.ProcessState)
+}
+
+// recordExit marks a container as stopped with the exit status of its init process
+func recordExit(containerDir string, state *os.ProcessState) {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return
+	}
+
+	// The container may have been removed in the meantime, there is nothing to record then
+	updateState(containerDir, func(c *Container) {
+		c.Status = StatusStopped
+		c.FinishedAt = time.Now()
+		c.ExitCode = exitCode(status)
+		c.ExitSignal = ""
+		if status.Signaled() {
+			c.ExitSignal = unix.SignalName(status.Signal())
+		}
+	})
+}
+
+// exitCode returns the exit code of a process like a shell does: 128 plus the signal number for a killed one
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// waitForMonitor gives the monitor of a killed container a moment to record the exit,
+// so it is not writing the state file while the container directory is removed
+func waitForMonitor(c Container) {
+	if monitor, err := openProcess(c.MonitorPID, c.MonitorStartTime); err == nil {
+		monitor.wait(2 * time.Second)
+		monitor.Close()
+	}
+}
+
+// WaitContainer blocks until a container's process exits and returns its exit code
+func WaitContainer(name string) (int, error) {
+	c := findContainer(name)
+	if c == nil {
+		return 0, fmt.Errorf("container '%s' not found", name)
+	}
+
+	for {
+		current, err := loadState(c.Location)
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("container '%s' was removed", name)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if current.Status == StatusStopped && !current.FinishedAt.IsZero() {
+			return current.ExitCode, nil
+		}
+
+		// The monitor exits right after recording the exit, without one nobody is going to record it
+		monitor, err := openProcess(current.MonitorPID, current.MonitorStartTime)
+		if err != nil {
+			if current, err := loadState(c.Location); err == nil && !current.FinishedAt.IsZero() {
+				return current.ExitCode, nil
+			}
+			return 0, fmt.Errorf("the exit status of container '%s' was not recorded", name)
+		}
+		monitor.wait(-1)
+		monitor.Close()
+	}
+}
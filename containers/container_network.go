@@ -0,0 +1,437 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network modes of a container
+const (
+	NetworkBridge = "bridge" // own network namespace attached to the bridge
+	NetworkNone   = "none"   // own network namespace with only a loopback interface
+	NetworkHost   = "host"   // the host's network namespace
+	// "container:<name>" shares the network namespace of another container
+	networkContainerPrefix = "container:"
+)
+
+// BridgeName is the host bridge every bridged container is attached to
+const BridgeName = "malptainer0"
+
+// DefaultSubnet is used for the bridge unless MALPTAINER_SUBNET is set
+const DefaultSubnet = "10.88.0.0/16"
+
+// Name of the container's interface, the veth peer is renamed to it inside the namespace
+const containerInterface = "eth0"
+
+// ipamFileName holds the address leases, next to the container directories
+const ipamFileName = "ipam.json"
+
+// resolveNetworkMode validates the requested network mode, empty selects the default one
+func resolveNetworkMode(opts LaunchOptions) (string, error) {
+	mode := opts.Network
+	if mode == "" {
+		mode = NetworkBridge
+		if Rootless {
+			fmt.Fprintln(opts.Output, "Rootless: bridge networking needs root, the container only gets a loopback interface")
+			mode = NetworkNone
+		}
+	}
+
+	if len(opts.Ports) > 0 && mode != NetworkBridge {
+		return "", fmt.Errorf("publishing ports needs the bridge network mode, not %q", mode)
+	}
+
+	switch mode {
+	case NetworkBridge:
+		if Rootless {
+			return "", fmt.Errorf("bridge networking is not available in rootless mode")
+		}
+		return mode, nil
+	case NetworkNone, NetworkHost:
+		return mode, nil
+	}
+
+	name, ok := strings.CutPrefix(mode, networkContainerPrefix)
+	if !ok || name == "" {
+		return "", fmt.Errorf("invalid network mode %q, expected bridge, none, host or container:<name>", mode)
+	}
+
+	// Joining a network namespace needs CAP_SYS_ADMIN in the user namespace owning it
+	if opts.UserNS != nil {
+		return "", fmt.Errorf("network mode %q cannot be combined with a user namespace", mode)
+	}
+
+	target := findContainer(name)
+	if target == nil {
+		return "", fmt.Errorf("container '%s' not found", name)
+	}
+	if !containerAlive(*target) {
+		return "", fmt.Errorf("container '%s' is not running", name)
+	}
+	return mode, nil
+}
+
+// bridgeSubnet returns the configured subnet of the bridge network
+func bridgeSubnet() (*net.IPNet, error) {
+	subnet := os.Getenv("MALPTAINER_SUBNET")
+	if subnet == "" {
+		subnet = DefaultSubnet
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid bridge subnet %q, an IPv4 CIDR is required", subnet)
+	}
+	if ones, bits := ipNet.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("bridge subnet %s is too small", subnet)
+	}
+	return ipNet, nil
+}
+
+// gatewayAddress is the first address of the subnet, owned by the bridge
+func gatewayAddress(subnet *net.IPNet) net.IP {
+	return nextIP(subnet.IP.To4())
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// ipamState is the on-disk record of which container holds which address
+type ipamState struct {
+	Subnet string            `json:"subnet"`
+	Leases map[string]string `json:"leases"` // IP -> container name
+}
+
+// withIPAM runs fn with the lease file loaded and locked, saving it afterwards.
+// The lock keeps concurrent `malptainer run` invocations from handing out the same address.
+func withIPAM(fn func(state *ipamState) error) error {
+	if err := makeStoreDir(ContainersRoot); err != nil {
+		return err
+	}
+
+	// Only ever read by malptainer itself
+	path := filepath.Join(ContainersRoot, ipamFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open IP leases: %w", err)
+	}
+	defer file.Close()
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock IP leases: %w", err)
+	}
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+	state := ipamState{Leases: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("corrupt IP leases file %s: %w", path, err)
+		}
+		if state.Leases == nil {
+			state.Leases = map[string]string{}
+		}
+	}
+
+	if err := fn(&state); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, 0)
+	return err
+}
+
+// allocateIP leases the lowest free address of the subnet to the container
+func allocateIP(containerName string, subnet *net.IPNet) (net.IP, error) {
+	var allocated net.IP
+
+	err := withIPAM(func(state *ipamState) error {
+		// Leases of another subnet are meaningless once the subnet was changed
+		if state.Subnet != subnet.String() {
+			state.Subnet = subnet.String()
+			state.Leases = map[string]string{}
+		}
+
+		broadcast := make(net.IP, 4)
+		for i := range broadcast {
+			broadcast[i] = subnet.IP.To4()[i] | ^subnet.Mask[i]
+		}
+
+		for ip := nextIP(gatewayAddress(subnet)); subnet.Contains(ip) && !ip.Equal(broadcast); ip = nextIP(ip) {
+			if _, taken := state.Leases[ip.String()]; !taken {
+				state.Leases[ip.String()] = containerName
+				allocated = ip
+				return nil
+			}
+		}
+		return fmt.Errorf("no free address left in %s", subnet)
+	})
+
+	return allocated, err
+}
+
+// releaseIP gives the container's address back
+func releaseIP(containerName string) error {
+	return withIPAM(func(state *ipamState) error {
+		for ip, owner := range state.Leases {
+			if owner == containerName {
+				delete(state.Leases, ip)
+			}
+		}
+		return nil
+	})
+}
+
+// ensureBridge creates the bridge on first use, and sets up forwarding and NAT for the subnet
+func ensureBridge(subnet *net.IPNet, out io.Writer) error {
+	if _, err := net.InterfaceByName(BridgeName); err != nil {
+		fmt.Fprintf(out, "Creating bridge %s for %s\n", BridgeName, subnet)
+		if err := linkAddBridge(BridgeName); err != nil {
+			return err
+		}
+	}
+
+	prefixLen, _ := subnet.Mask.Size()
+	gateway := &net.IPNet{IP: gatewayAddress(subnet), Mask: net.CIDRMask(prefixLen, 32)}
+	if err := addrAdd(BridgeName, gateway); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	if err := linkSetUp(BridgeName); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		fmt.Fprintf(out, "Warning: could not enable IP forwarding, containers will have no egress: %v\n", err)
+	}
+
+	// Masquerade traffic leaving the subnet through anything but the bridge, and let it be forwarded
+	rules := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet.String(), "!", "-o", BridgeName, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", BridgeName, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", BridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	for _, rule := range rules {
+		if err := ensureIptablesRule(rule[0], rule[1], rule[2], rule[3:]...); err != nil {
+			fmt.Fprintf(out, "Warning: %v, containers may have no egress\n", err)
+		}
+	}
+
+	return nil
+}
+
+// ensureIptablesRule appends a rule to a chain unless it is already there
+func ensureIptablesRule(tableFlag, table, chain string, rule ...string) error {
+	check := append([]string{tableFlag, table, "-C", chain}, rule...)
+	if exec.Command("iptables", check...).Run() == nil {
+		return nil
+	}
+
+	add := append([]string{tableFlag, table, "-A", chain}, rule...)
+	if out, err := exec.Command("iptables", add...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %v %s", strings.Join(add, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Used when none of the host's nameservers can be reached from the bridge
+var fallbackNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// containerResolvConf returns the /etc/resolv.conf of a container for its network mode
+func containerResolvConf(c Container) []byte {
+	switch {
+	case c.NetworkMode == NetworkNone:
+		// Nothing to resolve without a network
+		return nil
+	case strings.HasPrefix(c.NetworkMode, networkContainerPrefix):
+		target := findContainer(strings.TrimPrefix(c.NetworkMode, networkContainerPrefix))
+		if target != nil {
+			if data, err := os.ReadFile(filepath.Join(target.Location, "resolv.conf")); err == nil {
+				return data
+			}
+		}
+	}
+
+	hostConf, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil || c.Network == nil {
+		return hostConf
+	}
+
+	// A nameserver on the host's loopback (like systemd-resolved's 127.0.0.53) can't be reached from the bridge
+	var lines []string
+	nameservers := 0
+	for _, line := range strings.Split(strings.TrimRight(string(hostConf), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil && ip.IsLoopback() {
+				continue
+			}
+			nameservers++
+		}
+		lines = append(lines, line)
+	}
+	if nameservers == 0 {
+		for _, ns := range fallbackNameservers {
+			lines = append(lines, "nameserver "+ns)
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// vethNames returns the host and (temporary) container side names of a container's veth pair.
+// Interface names are limited to 15 characters, so they are built from the random part of the name.
+func vethNames(containerName string) (string, string) {
+	id := strings.TrimPrefix(containerName, "container-")
+	if len(id) > 10 {
+		id = id[:10]
+	}
+	return "mv" + id, "mc" + id
+}
+
+// setupBridgeNetwork allocates an address for the container and prepares the bridge
+func setupBridgeNetwork(c *Container, out io.Writer) error {
+	subnet, err := bridgeSubnet()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureBridge(subnet, out); err != nil {
+		return err
+	}
+
+	ip, err := allocateIP(c.Name, subnet)
+	if err != nil {
+		return err
+	}
+
+	prefixLen, _ := subnet.Mask.Size()
+	hostVeth, _ := vethNames(c.Name)
+	c.Network = &NetworkConfig{
+		Bridge:    BridgeName,
+		IPAddress: ip.String(),
+		PrefixLen: prefixLen,
+		Gateway:   gatewayAddress(subnet).String(),
+		HostVeth:  hostVeth,
+	}
+	return nil
+}
+
+// attachContainerNetwork creates the container's veth pair and moves one end into the namespace of pid
+func attachContainerNetwork(c *Container, pid int) error {
+	hostVeth, peer := vethNames(c.Name)
+
+	if err := linkAddVeth(hostVeth, peer); err != nil {
+		return err
+	}
+	if err := linkSetMaster(hostVeth, BridgeName); err != nil {
+		linkDelete(hostVeth)
+		return err
+	}
+	if err := linkSetUp(hostVeth); err != nil {
+		linkDelete(hostVeth)
+		return err
+	}
+	if err := linkSetNsPid(peer, pid); err != nil {
+		linkDelete(hostVeth)
+		return err
+	}
+	return nil
+}
+
+// teardownNetwork removes the host side of the container's veth pair and releases its address.
+// The bridge and NAT rules are shared and stay in place.
+func teardownNetwork(c Container) {
+	if c.Network == nil {
+		return
+	}
+
+	// The veth is usually gone already, it disappears with the container's network namespace
+	if _, err := net.InterfaceByName(c.Network.HostVeth); err == nil {
+		if err := linkDelete(c.Network.HostVeth); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if err := releaseIP(c.Name); err != nil {
+		fmt.Printf("Warning: could not release address of %s: %v\n", c.Name, err)
+	}
+}
+
+// networkNamespaceOf opens the network namespace a container:<name> mode refers to
+func networkNamespaceOf(mode string) (*os.File, error) {
+	name := strings.TrimPrefix(mode, networkContainerPrefix)
+	target := findContainer(name)
+	if target == nil || !containerAlive(*target) {
+		return nil, fmt.Errorf("container '%s' is not running", name)
+	}
+
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", target.NamespacePID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace of %s: %w", name, err)
+	}
+	return ns, nil
+}
+
+// joinNetworkNamespace moves the calling thread into the network namespace open at fd
+func joinNetworkNamespace(fd int) error {
+	defer unix.Close(fd)
+	if err := unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("failed to join network namespace: %w", err)
+	}
+	return nil
+}
+
+// configureContainerNetwork runs inside the container's network namespace: it brings the loopback up and,
+// for bridged containers, renames the veth peer to eth0, assigns the address and adds the default route
+func configureContainerNetwork(peer, address, gateway string) error {
+	if err := linkSetUp("lo"); err != nil {
+		return err
+	}
+
+	if peer == "" {
+		return nil
+	}
+
+	if err := linkRename(peer, containerInterface); err != nil {
+		return err
+	}
+
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("invalid container address %q: %w", address, err)
+	}
+	if err := addrAdd(containerInterface, &net.IPNet{IP: ip, Mask: ipNet.Mask}); err != nil {
+		return err
+	}
+	if err := linkSetUp(containerInterface); err != nil {
+		return err
+	}
+	return routeAddDefault(net.ParseIP(gateway), containerInterface)
+}
@@ -0,0 +1,65 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Ways a container's root filesystem can be provided
+const (
+	StorageOverlay = "overlay" // the source is the read-only lower layer, changes go to the container's upper dir
+	StorageCopy    = "copy"    // the source is copied into the container directory
+)
+
+// overlayOptions returns the mount options of an overlay over lower with its upper and work dirs
+func overlayOptions(lower, upper, work string) string {
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+}
+
+// overlayUnavailable reports why the container's root filesystem has to be copied instead of overlaid,
+// an empty reason means overlayfs can be used
+func overlayUnavailable(opts LaunchOptions) string {
+	// The lower layer would show up as owned by nobody in a user namespace
+	if opts.UserNS != nil {
+		return "user namespaces need a chowned copy"
+	}
+
+	filesystems, err := os.ReadFile("/proc/filesystems")
+	if err != nil || !strings.Contains(string(filesystems), "\toverlay\n") {
+		return "the kernel does not support overlayfs"
+	}
+	return ""
+}
+
+// prepareOverlay creates the upper and work dirs of a container and checks that the overlay
+// can actually be mounted, some filesystems can't hold the upper dir
+func prepareOverlay(lower, upper, work, target string) error {
+	for _, dir := range []string{upper, work, target} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Mount("overlay", target, "overlay", 0, overlayOptions(lower, upper, work)); err != nil {
+		return err
+	}
+	return unix.Unmount(target, 0)
+}
+
+// writableRootfs is where files added to a container from the host have to be written,
+// the merged root filesystem is only mounted inside the container
+func writableRootfs(c *Container) string {
+	if c.Storage == StorageOverlay {
+		return c.UpperDir
+	}
+	return c.RootfsLocation
+}
+
+// overlayDirs returns the upper and work dirs of a container directory
+func overlayDirs(containerPath string) (string, string) {
+	return filepath.Join(containerPath, "upper"), filepath.Join(containerPath, "work")
+}
@@ -0,0 +1,301 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PortMapping publishes a container port on the host
+type PortMapping struct {
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol"` // "tcp" or "udp"
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%d->%d/%s", p.HostPort, p.ContainerPort, p.Protocol)
+}
+
+// How long a UDP client may stay silent before its upstream socket is closed
+const udpProxyTimeout = 60 * time.Second
+
+// ParsePortMapping parses a hostPort:containerPort[/tcp|udp] mapping
+func ParsePortMapping(value string) (PortMapping, error) {
+	mapping := PortMapping{Protocol: "tcp"}
+
+	ports, protocol, found := strings.Cut(value, "/")
+	if found {
+		mapping.Protocol = strings.ToLower(protocol)
+		if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+			return PortMapping{}, fmt.Errorf("invalid protocol %q in port mapping %q, expected tcp or udp", protocol, value)
+		}
+	}
+
+	hostPort, containerPort, found := strings.Cut(ports, ":")
+	if !found {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q, expected hostPort:containerPort[/tcp|udp]", value)
+	}
+
+	var err error
+	if mapping.HostPort, err = parsePort(hostPort); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q: %w", value, err)
+	}
+	if mapping.ContainerPort, err = parsePort(containerPort); err != nil {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q: %w", value, err)
+	}
+	return mapping, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+// validatePortMappings rejects the same host port being published twice
+func validatePortMappings(ports []PortMapping) error {
+	seen := map[string]bool{}
+	for _, p := range ports {
+		key := fmt.Sprintf("%d/%s", p.HostPort, p.Protocol)
+		if seen[key] {
+			return fmt.Errorf("host port %s is published more than once", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// startPortProxy starts the userspace proxy forwarding the published ports to the container.
+// The proxy runs as a detached `malptainer proxy` process so it outlives the command that launched the
+// container, and reports back over a pipe once all its listeners are bound.
+func startPortProxy(c *Container) error {
+	if len(c.Ports) == 0 {
+		return nil
+	}
+
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create proxy status pipe: %w", err)
+	}
+	defer statusRead.Close()
+
+	args := []string{"proxy", c.Network.IPAddress}
+	for _, p := range c.Ports {
+		args = append(args, fmt.Sprintf("%d:%d/%s", p.HostPort, p.ContainerPort, p.Protocol))
+	}
+
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{statusWrite} // fd 3 in the proxy
+
+	err = cmd.Start()
+	statusWrite.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start port proxy: %w", err)
+	}
+	// Reap it if it exits while the manager is still around
+	go cmd.Wait()
+
+	// The proxy writes "ok", or why it could not bind, and closes the pipe
+	status, _ := io.ReadAll(statusRead)
+	if msg := strings.TrimSpace(string(status)); msg != "ok" {
+		cmd.Process.Kill()
+		if msg == "" {
+			msg = "port proxy exited unexpectedly"
+		}
+		return errors.New(msg)
+	}
+
+	c.ProxyPID = cmd.Process.Pid
+	if startTime, err := processStartTime(c.ProxyPID); err == nil {
+		c.ProxyStartTime = startTime
+	}
+	return nil
+}
+
+// stopPortProxy stops the container's port proxy, unless it already exited
+func stopPortProxy(c Container) {
+	// Without its start time an unrelated process that took over the PID can't be told apart
+	if c.ProxyPID <= 0 || c.ProxyStartTime == 0 {
+		return
+	}
+
+	if err := killAndWait(c.ProxyPID, c.ProxyStartTime, 2*time.Second); err != nil {
+		fmt.Printf("Warning: could not stop port proxy of %s: %v\n", c.Name, err)
+	}
+}
+
+// RunPortProxy is the entry point of the `malptainer proxy <containerIP> <mapping>...` helper process
+func RunPortProxy(args []string) {
+	status := os.NewFile(3, "status")
+	fail := func(format string, a ...any) {
+		fmt.Fprintf(status, format, a...)
+		status.Close()
+		os.Exit(1)
+	}
+
+	if len(args) < 2 {
+		fail("usage: proxy <containerIP> <mapping>...")
+	}
+	containerIP := args[0]
+
+	// Bind everything first so a taken port fails the launch instead of going unnoticed
+	var starts []func()
+	for _, arg := range args[1:] {
+		mapping, err := ParsePortMapping(arg)
+		if err != nil {
+			fail("%v", err)
+		}
+		target := net.JoinHostPort(containerIP, strconv.Itoa(mapping.ContainerPort))
+		listen := fmt.Sprintf(":%d", mapping.HostPort)
+
+		if mapping.Protocol == "udp" {
+			conn, err := net.ListenPacket("udp", listen)
+			if err != nil {
+				fail("failed to publish port %s: %v", mapping, err)
+			}
+			starts = append(starts, func() { proxyUDP(conn.(*net.UDPConn), target) })
+			continue
+		}
+
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			fail("failed to publish port %s: %v", mapping, err)
+		}
+		starts = append(starts, func() { proxyTCP(listener, target) })
+	}
+
+	fmt.Fprint(status, "ok")
+	status.Close()
+
+	for _, start := range starts {
+		go start()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+}
+
+// proxyTCP forwards every accepted connection to the container
+func proxyTCP(listener net.Listener, target string) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer client.Close()
+
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+
+			// Copy both ways, passing on half-closes so request/response protocols keep working
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				io.Copy(upstream, client)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				defer wg.Done()
+				io.Copy(client, upstream)
+				client.(*net.TCPConn).CloseWrite()
+			}()
+			wg.Wait()
+		}()
+	}
+}
+
+// udpSession is the upstream socket of one UDP client
+type udpSession struct {
+	upstream *net.UDPConn
+	lastSent time.Time
+}
+
+// proxyUDP forwards datagrams to the container, with one upstream socket per client
+// so replies find their way back. A session is dropped once it was idle for udpProxyTimeout.
+func proxyUDP(conn *net.UDPConn, target string) {
+	// Held while sending as well, so a session is never closed between looking it up and writing to it
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	buf := make([]byte, 65535)
+
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		session, ok := sessions[client.String()]
+		if !ok {
+			addr, err := net.ResolveUDPAddr("udp", target)
+			var upstream *net.UDPConn
+			if err == nil {
+				upstream, err = net.DialUDP("udp", nil, addr)
+			}
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			session = &udpSession{upstream: upstream}
+			sessions[client.String()] = session
+			go relayUDPReplies(conn, client, session, sessions, &mu)
+		}
+
+		session.lastSent = time.Now()
+		session.upstream.SetReadDeadline(session.lastSent.Add(udpProxyTimeout))
+		session.upstream.Write(buf[:n])
+		mu.Unlock()
+	}
+}
+
+// relayUDPReplies sends the replies of a session back to its client until the session is idle
+func relayUDPReplies(conn *net.UDPConn, client *net.UDPAddr, session *udpSession, sessions map[string]*udpSession, mu *sync.Mutex) {
+	reply := make([]byte, 65535)
+	for {
+		n, err := session.upstream.Read(reply)
+		if err == nil {
+			conn.WriteToUDP(reply[:n], client)
+			continue
+		}
+
+		mu.Lock()
+		// A datagram sent while the deadline expired moved it already, keep waiting for its reply
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(session.lastSent) < udpProxyTimeout {
+			mu.Unlock()
+			continue
+		}
+		delete(sessions, client.String())
+		session.upstream.Close()
+		mu.Unlock()
+		return
+	}
+}
+
+// formatPorts renders the published ports for the container list
+func formatPorts(ports []PortMapping) string {
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, ", ")
+}
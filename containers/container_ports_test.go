@@ -0,0 +1,57 @@
+package container
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyUDP(t *testing.T) {
+	// An echo server standing in for the container
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	proxy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxyUDP(proxy, echo.LocalAddr().String())
+
+	// Two clients get their own sessions, each reply goes back to its sender
+	for _, message := range []string{"first", "second"} {
+		client, err := net.DialUDP("udp", nil, proxy.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		for i := 0; i < 3; i++ {
+			if _, err := client.Write([]byte(message)); err != nil {
+				t.Fatal(err)
+			}
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, 1500)
+			n, err := client.Read(reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(reply[:n]) != message {
+				t.Errorf("got %q, want %q", reply[:n], message)
+			}
+		}
+	}
+}
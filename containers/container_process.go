@@ -0,0 +1,301 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PATH of a container process unless the image or the user sets one
+var defaultPath = strings.Join(containerSearchPath, ":")
+
+// ProcessSpec describes the process run in a container
+type ProcessSpec struct {
+	Args []string `json:"args"` // the binary as given at launch, then its arguments
+	Env  []string `json:"env"`
+	Cwd  string   `json:"cwd"`
+	User string   `json:"user,omitempty"` // user[:group], resolved inside the container
+}
+
+// processUser is the user a container process runs as, resolved against the container's /etc/passwd and /etc/group
+type processUser struct {
+	UID    int
+	GID    int
+	Groups []int
+	Home   string
+}
+
+// newProcessSpec builds the process of a new container. The environment starts from PATH and the
+// image's, then the options override it. The image also provides the default working directory and user.
+func newProcessSpec(opts LaunchOptions, config *ImageConfig) (ProcessSpec, error) {
+	if config == nil {
+		config = &ImageConfig{}
+	}
+	spec := ProcessSpec{
+		Args: append([]string{opts.BinaryPath}, opts.Args...),
+		Env:  mergeEnv([]string{"PATH=" + defaultPath}, config.Env...),
+		Cwd:  config.WorkingDir,
+		User: config.User,
+	}
+
+	for _, entry := range opts.Env {
+		entry, ok, err := resolveEnvEntry(entry)
+		if err != nil {
+			return ProcessSpec{}, err
+		}
+		if ok {
+			spec.Env = mergeEnv(spec.Env, entry)
+		}
+	}
+
+	if opts.WorkingDir != "" {
+		spec.Cwd = opts.WorkingDir
+	}
+	if spec.Cwd == "" {
+		spec.Cwd = "/"
+	}
+	if !path.IsAbs(spec.Cwd) {
+		return ProcessSpec{}, fmt.Errorf("working directory %q is not an absolute path", spec.Cwd)
+	}
+	spec.Cwd = path.Clean(spec.Cwd)
+
+	if opts.User != "" {
+		spec.User = opts.User
+	}
+	if err := validateUserSpec(spec.User); err != nil {
+		return ProcessSpec{}, err
+	}
+	return spec, nil
+}
+
+// ParseEnvFile reads the NAME=value lines of an env file. Blank lines and lines starting with # are
+// skipped, a line with just a NAME takes its value from the host's environment.
+func ParseEnvFile(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimLeft(scanner.Text(), " \t")
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if _, _, err := resolveEnvEntry(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		env = append(env, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// resolveEnvEntry checks a NAME=value entry. A bare NAME takes the value of the host's environment,
+// it is dropped when the host does not have it.
+func resolveEnvEntry(entry string) (string, bool, error) {
+	name, _, hasValue := strings.Cut(entry, "=")
+	if name == "" || strings.ContainsAny(name, " \t") || strings.ContainsRune(entry, 0) {
+		return "", false, fmt.Errorf("invalid environment variable %q", entry)
+	}
+	if hasValue {
+		return entry, true, nil
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", false, nil
+	}
+	return name + "=" + value, true, nil
+}
+
+// mergeEnv adds NAME=value entries to env, replacing the earlier value of a variable
+func mergeEnv(env []string, entries ...string) []string {
+	merged := append([]string{}, env...)
+	for _, entry := range entries {
+		name, _, _ := strings.Cut(entry, "=")
+		replaced := false
+		for i, existing := range merged {
+			if existingName, _, _ := strings.Cut(existing, "="); existingName == name {
+				merged[i] = entry
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+// hasEnv reports whether env sets the variable name
+func hasEnv(env []string, name string) bool {
+	for _, entry := range env {
+		if entryName, _, _ := strings.Cut(entry, "="); entryName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUserSpec checks the user[:group] syntax, the names are only known inside the container
+func validateUserSpec(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	user, group, hasGroup := strings.Cut(spec, ":")
+	if user == "" || (hasGroup && group == "") || strings.Contains(group, ":") {
+		return fmt.Errorf("invalid user %q, expected user[:group]", spec)
+	}
+	return nil
+}
+
+// resolveUser looks up a user[:group] spec in /etc/passwd and /etc/group, both names and IDs are accepted.
+// Runs after the pivot_root, so the files are the container's. An empty spec is root.
+func resolveUser(spec string) (processUser, error) {
+	userPart, groupPart, _ := strings.Cut(spec, ":")
+	if userPart == "" {
+		userPart = "0"
+	}
+
+	passwd, err := readIDFile("/etc/passwd")
+	if err != nil {
+		return processUser{}, err
+	}
+	groups, err := readIDFile("/etc/group")
+	if err != nil {
+		return processUser{}, err
+	}
+
+	// Users that are not in /etc/passwd can still be given by ID, like root without an /etc/passwd
+	user := processUser{GID: 0, Home: "/"}
+	var userName string
+	uid, numeric := parseID(userPart)
+	entry, found := findIDEntry(passwd, userPart, numeric)
+	switch {
+	case found:
+		userName = entry[0]
+		user.UID, _ = parseID(entry[2])
+		if len(entry) > 3 {
+			user.GID, _ = parseID(entry[3])
+		}
+		if len(entry) > 5 && entry[5] != "" {
+			user.Home = entry[5]
+		}
+	case numeric:
+		user.UID = uid
+	default:
+		return processUser{}, fmt.Errorf("no user %q in the container's /etc/passwd", userPart)
+	}
+
+	if groupPart != "" {
+		gid, numeric := parseID(groupPart)
+		entry, found := findIDEntry(groups, groupPart, numeric)
+		switch {
+		case found:
+			user.GID, _ = parseID(entry[2])
+		case numeric:
+			user.GID = gid
+		default:
+			return processUser{}, fmt.Errorf("no group %q in the container's /etc/group", groupPart)
+		}
+	}
+
+	// The primary group, then every group listing the user as a member
+	user.Groups = []int{user.GID}
+	for _, entry := range groups {
+		if userName == "" || len(entry) < 4 {
+			continue
+		}
+		gid, ok := parseID(entry[2])
+		if !ok || gid == user.GID {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if strings.TrimSpace(member) == userName {
+				user.Groups = append(user.Groups, gid)
+				break
+			}
+		}
+	}
+	return user, nil
+}
+
+// readIDFile reads the colon separated entries of /etc/passwd or /etc/group, a missing file has none
+func readIDFile(filename string) ([][]string, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:ID, followed by the primary group in /etc/passwd or the members in /etc/group
+		if fields := strings.Split(line, ":"); len(fields) >= 3 {
+			entries = append(entries, fields)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// findIDEntry finds an entry by ID when numeric, by name otherwise
+func findIDEntry(entries [][]string, key string, numeric bool) ([]string, bool) {
+	for _, entry := range entries {
+		if (numeric && entry[2] == key) || (!numeric && entry[0] == key) {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// parseID parses a user or group ID
+func parseID(s string) (int, bool) {
+	id, err := strconv.ParseUint(s, 10, 31)
+	if err != nil {
+		return 0, false
+	}
+	return int(id), true
+}
+
+// switchUser changes the credentials of the process. For a non-root user this clears the effective, permitted
+// and ambient capabilities. Supplementary groups can't be set when rootless, setgroups is denied there.
+func switchUser(user processUser, rootless bool) error {
+	if !rootless {
+		if err := syscall.Setgroups(user.Groups); err != nil {
+			return fmt.Errorf("failed to set supplementary groups: %w", err)
+		}
+	} else if len(user.Groups) > 1 {
+		fmt.Printf("Container init: rootless: supplementary groups of the user are not set, setgroups is denied\n")
+	}
+	// EINVAL is an ID the user namespace does not map
+	if err := syscall.Setgid(user.GID); errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("group %d is not mapped in the container's user namespace", user.GID)
+	} else if err != nil {
+		return fmt.Errorf("failed to switch to group %d: %w", user.GID, err)
+	}
+	if err := syscall.Setuid(user.UID); errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("user %d is not mapped in the container's user namespace", user.UID)
+	} else if err != nil {
+		return fmt.Errorf("failed to switch to user %d: %w", user.UID, err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runAsInit is the end of RunContainerInit with --init: instead of exec'ing the application we stay PID 1
+// and run it as our child, forwarding it every signal we get and reaping the processes orphaned in the
+// container. We exit with the application's exit status once it exits, 128 plus the signal number when
+// it was killed, which takes the rest of the container down with us.
+func runAsInit(binaryPath string, args, env []string, console bool) {
+	// Registered first so no SIGCHLD or SIGTERM is missed, every signal goes to the channel from here on
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+
+	// Its own process group, the foreground one of the container's terminal with -t so ctrl-c reaches it once
+	pid, err := syscall.ForkExec(binaryPath, args, &syscall.ProcAttr{
+		Env:   env,
+		Files: []uintptr{0, 1, 2},
+		Sys:   &syscall.SysProcAttr{Setpgid: true, Foreground: console, Ctty: 0},
+	})
+	if err != nil {
+		fatal("exec failed: %v", err)
+	}
+	reportStatus(initStatus{Ready: true})
+	initStatusPipe.Close()
+	initStatusPipe = nil
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, ok := reapChildren(pid); ok {
+				os.Exit(exitCode(status))
+			}
+		case syscall.SIGURG:
+			// Sent by the Go runtime to preempt our own goroutines
+		default:
+			syscall.Kill(pid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// reapChildren waits for every child that exited, and returns the exit status of the application when it did
+func reapChildren(app int) (syscall.WaitStatus, bool) {
+	var appStatus syscall.WaitStatus
+	appExited := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return appStatus, appExited
+		}
+		if pid == app {
+			appStatus, appExited = status, true
+		}
+	}
+}
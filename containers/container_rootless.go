@@ -0,0 +1,106 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Rootless is set when the manager runs as an unprivileged user.
+// Containers then always get a user namespace mapping container root to the calling user,
+// and their state lives under $XDG_RUNTIME_DIR instead of the working directory.
+var Rootless = os.Geteuid() != 0
+
+func init() {
+	if Rootless {
+		ContainersRoot = rootlessContainersRoot()
+		ImagesRoot = rootlessImagesRoot()
+	}
+}
+
+// rootlessFallbackDir is used without $XDG_RUNTIME_DIR or a home directory, like most XDG aware tools do.
+// Its name is predictable in a directory everyone can write to, see makeStoreDir.
+var rootlessFallbackDir = filepath.Join(os.TempDir(), fmt.Sprintf("malptainer-%d", os.Geteuid()))
+
+// rootlessContainersRoot returns the per-user directory holding the containers in rootless mode
+func rootlessContainersRoot() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = rootlessFallbackDir
+	}
+	return filepath.Join(runtimeDir, "malptainer", "containers")
+}
+
+// rootlessImagesRoot returns the per-user image store, images are kept across reboots unlike containers
+func rootlessImagesRoot() string {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join(rootlessFallbackDir, "images")
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataDir, "malptainer", "images")
+}
+
+// makeStoreDir creates a directory of the container or image store. Below the rootless fallback directory
+// that one is made private to us first: anyone could have created it, or a link in its place, before we did.
+func makeStoreDir(dir string) error {
+	if Rootless && (dir == rootlessFallbackDir || strings.HasPrefix(dir, rootlessFallbackDir+"/")) {
+		if err := makePrivateDir(rootlessFallbackDir); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// makePrivateDir creates dir accessible to us only, and refuses an existing one someone else could control
+func makePrivateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory, remove it or set XDG_RUNTIME_DIR", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by another user, remove it or set XDG_RUNTIME_DIR", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
+
+// rootlessUserNamespace maps container root to the calling user and group.
+// Without privileges the kernel only allows a single mapping of our own IDs.
+func rootlessUserNamespace() *UserNamespace {
+	return &UserNamespace{
+		UIDMappings: []IDMap{{ContainerID: 0, HostID: os.Geteuid(), Size: 1}},
+		GIDMappings: []IDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}},
+	}
+}
+
+// checkRootlessUserNamespace makes sure requested mappings can be written without privileges
+func checkRootlessUserNamespace(userNS *UserNamespace) error {
+	allowed := rootlessUserNamespace()
+	if len(userNS.UIDMappings) != 1 || userNS.UIDMappings[0] != allowed.UIDMappings[0] ||
+		len(userNS.GIDMappings) != 1 || userNS.GIDMappings[0] != allowed.GIDMappings[0] {
+		return fmt.Errorf("rootless mode can only map container root to your own UID %d and GID %d",
+			os.Geteuid(), os.Getegid())
+	}
+	return nil
+}
+
+// rootlessCgroupParent is the cgroup systemd delegates to the user's service manager
+func rootlessCgroupParent() string {
+	uid := os.Geteuid()
+	return fmt.Sprintf("user.slice/user-%d.slice/user@%d.service/malptainer", uid, uid)
+}
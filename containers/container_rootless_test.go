@@ -0,0 +1,53 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakePrivateDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "private")
+	if err := makePrivateDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("created with %v, %v", info.Mode(), err)
+	}
+
+	// An existing directory of ours is tightened
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := makePrivateDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(dir); info.Mode().Perm() != 0700 {
+		t.Errorf("left with %v", info.Mode())
+	}
+}
+
+func TestMakePrivateDirRefusesPlanted(t *testing.T) {
+	parent := t.TempDir()
+	link := filepath.Join(parent, "link")
+	if err := os.Symlink(t.TempDir(), link); err != nil {
+		t.Fatal(err)
+	}
+	if err := makePrivateDir(link); err == nil {
+		t.Error("a link was accepted")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating a directory owned by another user takes root")
+	}
+	foreign := filepath.Join(parent, "foreign")
+	if err := os.Mkdir(foreign, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(foreign, 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if err := makePrivateDir(foreign); err == nil {
+		t.Error("a directory of another user was accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The kernel only looks at this many bytes of a script for the #! line
+const shebangMaxLength = 256
+
+// PATH the interpreter of a #!/usr/bin/env script is looked up in, inside the container
+var containerSearchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// MissingInterpreterError is returned when a script's interpreter does not exist in the container's root filesystem
+type MissingInterpreterError struct {
+	Script      string
+	Interpreter string
+	Rootfs      string // the image, or ./root_fs
+	OnHost      bool   // the interpreter exists on the host and could be copied
+}
+
+func (e *MissingInterpreterError) Error() string {
+	msg := fmt.Sprintf("%s is run by %s, which does not exist in %s", e.Script, e.Interpreter, e.Rootfs)
+	if !e.OnHost {
+		msg += " nor on the host"
+	}
+	return msg
+}
+
+// readShebang returns the interpreter and optional argument of a #! script, an empty interpreter
+// when the file is not a script
+func readShebang(path string) (string, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, shebangMaxLength)
+	n, _ := file.Read(head)
+	head = head[:n]
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return "", "", nil
+	}
+
+	line, _, _ := bufio.NewReader(bytes.NewReader(head[2:])).ReadLine()
+	// Like the kernel: the interpreter, then everything after it as a single argument
+	fields := strings.TrimSpace(strings.ReplaceAll(string(line), "\t", " "))
+	interpreter, arg, _ := strings.Cut(fields, " ")
+	if interpreter == "" {
+		return "", "", fmt.Errorf("%s has an empty #! line", path)
+	}
+	return interpreter, strings.TrimSpace(arg), nil
+}
+
+// existsInRootfs reports whether path is an executable file in rootfs, following symlinks within it
+func existsInRootfs(rootfs, path string) bool {
+	resolved, err := resolveInRootFollow(rootfs, path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(resolved)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// scriptInterpreters returns the programs needed to run a script, as container paths: its interpreter,
+// and for #!/usr/bin/env scripts the program env runs. Binaries need none.
+func scriptInterpreters(script, rootfs string) ([]string, error) {
+	interpreter, arg, err := readShebang(script)
+	if err != nil || interpreter == "" {
+		return nil, err
+	}
+	if !filepath.IsAbs(interpreter) {
+		return nil, fmt.Errorf("%s: the interpreter %s has to be an absolute path", script, interpreter)
+	}
+
+	needed := []string{interpreter}
+	if filepath.Base(interpreter) == "env" {
+		if program := envProgram(arg); program != "" {
+			needed = append(needed, lookPathInRootfs(rootfs, program))
+		}
+	}
+	return needed, nil
+}
+
+// envProgram returns the program of an env #! line like "python3" or "-S python3 -u"
+func envProgram(arg string) string {
+	for _, field := range strings.Fields(arg) {
+		if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+			return field
+		}
+	}
+	return ""
+}
+
+// lookPathInRootfs finds a program in the container's PATH. When it is nowhere to be found, the
+// path it is copied to from the host is returned, which is on the container's PATH as well.
+func lookPathInRootfs(rootfs, program string) string {
+	if filepath.IsAbs(program) {
+		return program
+	}
+	for _, dir := range containerSearchPath {
+		if existsInRootfs(rootfs, filepath.Join(dir, program)) {
+			return filepath.Join(dir, program)
+		}
+	}
+	// Same place as on the host if the host has it in a standard directory
+	for _, dir := range containerSearchPath {
+		if info, err := os.Stat(filepath.Join(dir, program)); err == nil && info.Mode().IsRegular() {
+			return filepath.Join(dir, program)
+		}
+	}
+	return filepath.Join("/usr/local/bin", program)
+}
+
+// hostPathOf returns where a missing interpreter is copied from on the host
+func hostPathOf(interpreter string) (string, bool) {
+	candidates := []string{interpreter}
+	// A program env would run that the host only has outside of the standard directories
+	if filepath.Dir(interpreter) == "/usr/local/bin" {
+		if path, err := exec.LookPath(filepath.Base(interpreter)); err == nil {
+			candidates = append(candidates, path)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate, true
+		}
+	}
+	return interpreter, false
+}
+
+// The kernel follows at most this many interpreters that are scripts themselves
+const maxInterpreterDepth = 4
+
+// checkScriptInterpreters makes sure a script can be run in the root filesystem it is launched in.
+// With copyFromHost, missing interpreters are returned along with their libraries to be copied into the
+// container, otherwise a MissingInterpreterError is returned.
+func checkScriptInterpreters(script, rootfs, rootfsName string, copyFromHost bool, out io.Writer) ([]sharedObject, error) {
+	return checkInterpreters(script, script, rootfs, rootfsName, copyFromHost, out, 0)
+}
+
+func checkInterpreters(script, file, rootfs, rootfsName string, copyFromHost bool, out io.Writer, depth int) ([]sharedObject, error) {
+	if depth > maxInterpreterDepth {
+		return nil, fmt.Errorf("%s: too many levels of interpreters", script)
+	}
+
+	interpreters, err := scriptInterpreters(file, rootfs)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []sharedObject
+	for _, interpreter := range interpreters {
+		if existsInRootfs(rootfs, interpreter) {
+			continue
+		}
+
+		hostPath, onHost := hostPathOf(interpreter)
+		if !copyFromHost || !onHost {
+			return nil, &MissingInterpreterError{Script: script, Interpreter: interpreter, Rootfs: rootfsName, OnHost: onHost}
+		}
+
+		fmt.Fprintf(out, "Copying the interpreter %s from the host\n", hostPath)
+		objects = append(objects, sharedObject{hostPath: hostPath, containerPath: interpreter})
+		dependencies, err := binaryDependencies(hostPath, interpreter)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, dependencies...)
+
+		// The interpreter may be a script as well
+		nested, err := checkInterpreters(script, hostPath, rootfs, rootfsName, copyFromHost, out, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, nested...)
+	}
+	return objects, nil
+}
@@ -0,0 +1,422 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Special values of the seccomp profile option
+const (
+	SeccompDefault    = "default"
+	SeccompUnconfined = "unconfined"
+)
+
+// SeccompProfile is a Docker/OCI style seccomp profile
+type SeccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint            `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	Syscalls        []SeccompSyscall `json:"syscalls"`
+}
+
+// SeccompSyscall is one rule of a profile, applying an action to a group of system calls
+type SeccompSyscall struct {
+	Names    []string       `json:"names,omitempty"`
+	Name     string         `json:"name,omitempty"` // older profiles use a single name per rule
+	Action   string         `json:"action"`
+	ErrnoRet *uint          `json:"errnoRet,omitempty"`
+	Args     []SeccompArg   `json:"args,omitempty"`
+	Includes *SeccompFilter `json:"includes,omitempty"`
+	Excludes *SeccompFilter `json:"excludes,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+// SeccompArg compares a system call argument, all arguments of a rule must match
+type SeccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// SeccompFilter restricts a rule to containers with the given capabilities or architectures
+type SeccompFilter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// LoadSeccompProfile returns the profile selected by the seccomp option:
+// the built-in default profile, nil for unconfined, or a JSON profile read from a file
+func LoadSeccompProfile(option string) (*SeccompProfile, error) {
+	switch option {
+	case "", SeccompDefault:
+		return defaultSeccompProfile(), nil
+	case SeccompUnconfined:
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(option)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %w", err)
+	}
+
+	var profile SeccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", option, err)
+	}
+	return &profile, nil
+}
+
+// seccompProfileFile is where the resolved profile of a container is kept
+const seccompProfileFile = "seccomp.json"
+
+// writeSeccompProfile stores the resolved profile in the container directory for the init process
+func writeSeccompProfile(c Container, profile *SeccompProfile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(c.Location, seccompProfileFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write seccomp profile: %w", err)
+	}
+	return nil
+}
+
+// readSeccompProfile reads a resolved profile written by writeSeccompProfile
+func readSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile SeccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// resolveSeccompProfile evaluates the includes/excludes of every rule against the container's
+// capabilities and the host architecture, and returns a profile without conditional rules
+func resolveSeccompProfile(profile *SeccompProfile, capabilities []string) *SeccompProfile {
+	arch := seccompArchName()
+	resolved := &SeccompProfile{
+		DefaultAction:   profile.DefaultAction,
+		DefaultErrnoRet: profile.DefaultErrnoRet,
+	}
+
+	for _, rule := range profile.Syscalls {
+		if rule.Includes != nil && !seccompFilterMatches(rule.Includes, capabilities, arch, true) {
+			continue
+		}
+		if rule.Excludes != nil && seccompFilterMatches(rule.Excludes, capabilities, arch, false) {
+			continue
+		}
+
+		rule.Includes = nil
+		rule.Excludes = nil
+		resolved.Syscalls = append(resolved.Syscalls, rule)
+	}
+
+	return resolved
+}
+
+// seccompFilterMatches checks an includes (all listed must be present) or excludes (any listed present) filter
+func seccompFilterMatches(filter *SeccompFilter, capabilities []string, arch string, all bool) bool {
+	checks := []bool{}
+	for _, c := range filter.Caps {
+		capName, err := normalizeCapability(c)
+		checks = append(checks, err == nil && containsString(capabilities, capName))
+	}
+	if len(filter.Arches) > 0 {
+		checks = append(checks, containsString(filter.Arches, arch))
+	}
+
+	if len(checks) == 0 {
+		return all
+	}
+	for _, ok := range checks {
+		if ok != all {
+			return !all
+		}
+	}
+	return all
+}
+
+// seccompArchName returns the libseccomp name of the host architecture
+func seccompArchName() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "SCMP_ARCH_X86_64"
+	case "arm64":
+		return "SCMP_ARCH_AARCH64"
+	}
+	return "SCMP_ARCH_" + runtime.GOARCH
+}
+
+// seccompAction translates a profile action into a seccomp return value
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+
+	switch action {
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// bpfInstruction is a classic BPF instruction whose jumps may still point at the end of its rule
+type bpfInstruction struct {
+	code   uint16
+	jt, jf int
+	k      uint32
+}
+
+// jumpNextRule is a placeholder jump target meaning "this rule does not match"
+const jumpNextRule = -1
+
+func bpfStmt(code uint16, k uint32) bpfInstruction {
+	return bpfInstruction{code: code, k: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf int) bpfInstruction {
+	return bpfInstruction{code: code, jt: jt, jf: jf, k: k}
+}
+
+// Offsets into struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// compileSeccompProfile turns a resolved profile into a BPF program for the host architecture.
+// Rules are checked in order and the first one that matches decides, otherwise the default action applies.
+func compileSeccompProfile(profile *SeccompProfile) ([]unix.SockFilter, error) {
+	if seccompArch == 0 {
+		return nil, fmt.Errorf("seccomp filtering is not supported on %s", runtime.GOARCH)
+	}
+
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// System calls made through another ABI (32-bit compat, x32) could bypass the rules, kill them outright
+	program := []bpfInstruction{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+	}
+	if x32SyscallBit != 0 {
+		program = append(program,
+			bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		)
+	}
+
+	for _, rule := range profile.Syscalls {
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+
+		names := rule.Names
+		if rule.Name != "" {
+			names = append([]string{rule.Name}, names...)
+		}
+
+		// Names unknown on this architecture are skipped, like libseccomp does
+		var numbers []uint32
+		for _, name := range names {
+			if nr, ok := syscallNumbers[name]; ok {
+				numbers = append(numbers, uint32(nr))
+			}
+		}
+		if len(numbers) == 0 {
+			continue
+		}
+
+		if len(rule.Args) == 0 {
+			program = append(program, compileSyscallList(numbers, action)...)
+			continue
+		}
+
+		for _, nr := range numbers {
+			block, err := compileSyscallWithArgs(nr, rule.Args, action)
+			if err != nil {
+				return nil, err
+			}
+			program = append(program, block...)
+		}
+	}
+
+	program = append(program, bpfStmt(unix.BPF_RET|unix.BPF_K, defaultAction))
+
+	if len(program) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp profile compiles to %d instructions, the kernel allows %d", len(program), unix.BPF_MAXINSNS)
+	}
+
+	filter := make([]unix.SockFilter, len(program))
+	for i, ins := range program {
+		if ins.jt < 0 || ins.jt > 255 || ins.jf < 0 || ins.jf > 255 {
+			return nil, fmt.Errorf("seccomp rule too large to compile")
+		}
+		filter[i] = unix.SockFilter{Code: ins.code, Jt: uint8(ins.jt), Jf: uint8(ins.jf), K: ins.k}
+	}
+	return filter, nil
+}
+
+// compileSyscallList returns the action for any of the system calls, in chunks that keep jumps in range
+func compileSyscallList(numbers []uint32, action uint32) []bpfInstruction {
+	const chunkSize = 128
+	var block []bpfInstruction
+
+	for start := 0; start < len(numbers); start += chunkSize {
+		chunk := numbers[start:min(start+chunkSize, len(numbers))]
+
+		block = append(block, bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr))
+		for i, nr := range chunk {
+			if i == len(chunk)-1 {
+				// Last one falls through to the return on a match and skips it otherwise
+				block = append(block, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1))
+			} else {
+				block = append(block, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, len(chunk)-1-i, 0))
+			}
+		}
+		block = append(block, bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+	}
+
+	return block
+}
+
+// compileSyscallWithArgs returns the action for a system call when all argument comparisons hold
+func compileSyscallWithArgs(nr uint32, args []SeccompArg, action uint32) ([]bpfInstruction, error) {
+	block := []bpfInstruction{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, jumpNextRule),
+	}
+
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("seccomp argument index %d out of range", arg.Index)
+		}
+		checks, err := compileArgCheck(arg)
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, checks...)
+	}
+	block = append(block, bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+
+	// Point the placeholder jumps past the end of the block
+	for i := range block {
+		if block[i].jt == jumpNextRule {
+			block[i].jt = len(block) - i - 1
+		}
+		if block[i].jf == jumpNextRule {
+			block[i].jf = len(block) - i - 1
+		}
+	}
+	return block, nil
+}
+
+// compileArgCheck compares a 64-bit argument in two 32-bit halves. On success execution continues
+// after the returned instructions, on failure it jumps to the next rule.
+func compileArgCheck(arg SeccompArg) ([]bpfInstruction, error) {
+	// Both supported architectures are little endian, the low word comes first
+	lowOffset := uint32(seccompDataArgs + 8*arg.Index)
+	highOffset := lowOffset + 4
+	loadLow := bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, lowOffset)
+	loadHigh := bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, highOffset)
+
+	valueLow, valueHigh := uint32(arg.Value), uint32(arg.Value>>32)
+	const (
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jgt = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		and = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	)
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []bpfInstruction{
+			loadHigh, bpfJump(jeq, valueHigh, 0, jumpNextRule),
+			loadLow, bpfJump(jeq, valueLow, 0, jumpNextRule),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []bpfInstruction{
+			loadHigh, bpfJump(jeq, valueHigh, 0, 2),
+			loadLow, bpfJump(jeq, valueLow, jumpNextRule, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		// value is the mask, valueTwo the expected result
+		return []bpfInstruction{
+			loadHigh, bpfStmt(and, valueHigh), bpfJump(jeq, uint32(arg.ValueTwo>>32), 0, jumpNextRule),
+			loadLow, bpfStmt(and, valueLow), bpfJump(jeq, uint32(arg.ValueTwo), 0, jumpNextRule),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		lowJump := uint16(jgt)
+		if arg.Op == "SCMP_CMP_GE" {
+			lowJump = jge
+		}
+		return []bpfInstruction{
+			loadHigh,
+			bpfJump(jgt, valueHigh, 3, 0), // high word bigger, done
+			bpfJump(jeq, valueHigh, 0, jumpNextRule),
+			loadLow,
+			bpfJump(lowJump, valueLow, 0, jumpNextRule),
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		lowJump := uint16(jge)
+		if arg.Op == "SCMP_CMP_LE" {
+			lowJump = jgt
+		}
+		return []bpfInstruction{
+			loadHigh,
+			bpfJump(jge, valueHigh, 0, 3), // high word smaller, done
+			bpfJump(jeq, valueHigh, 0, jumpNextRule),
+			loadLow,
+			bpfJump(lowJump, valueLow, jumpNextRule, 0),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported seccomp operator %q", arg.Op)
+}
+
+// installSeccompFilter sets no_new_privs and loads the filter for every thread of the process
+func installSeccompFilter(filter []unix.SockFilter) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
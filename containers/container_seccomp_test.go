@@ -0,0 +1,223 @@
+package container
+
+import (
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompData is the struct seccomp_data a filter is run against
+type seccompData struct {
+	nr   uint32
+	arch uint32
+	args [6]uint64
+}
+
+func (d seccompData) bytes() []byte {
+	// Filters are only compiled for little endian architectures
+	buf := make([]byte, seccompDataArgs+8*len(d.args))
+	binary.LittleEndian.PutUint32(buf[seccompDataNr:], d.nr)
+	binary.LittleEndian.PutUint32(buf[seccompDataArch:], d.arch)
+	for i, arg := range d.args {
+		binary.LittleEndian.PutUint64(buf[seccompDataArgs+8*i:], arg)
+	}
+	return buf
+}
+
+// runBPF interprets the instructions the compiler emits, like the kernel would
+func runBPF(t *testing.T, filter []unix.SockFilter, data seccompData) uint32 {
+	t.Helper()
+	input := data.bytes()
+	var a uint32
+
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			if int(ins.K)+4 > len(input) {
+				t.Fatalf("load out of seccomp_data at %d: offset %d", pc, ins.K)
+			}
+			a = binary.LittleEndian.Uint32(input[ins.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			a &= ins.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			pc += jumpOffset(a == ins.K, ins)
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			pc += jumpOffset(a > ins.K, ins)
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			pc += jumpOffset(a >= ins.K, ins)
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", ins.Code, pc)
+		}
+	}
+	t.Fatal("the program ran off its end")
+	return 0
+}
+
+func jumpOffset(cond bool, ins unix.SockFilter) int {
+	if cond {
+		return int(ins.Jt)
+	}
+	return int(ins.Jf)
+}
+
+const (
+	testRetAllow = unix.SECCOMP_RET_ALLOW
+	testRetDeny  = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	testRetKill  = unix.SECCOMP_RET_KILL_PROCESS
+)
+
+func compileTestProfile(t *testing.T, rules ...SeccompSyscall) []unix.SockFilter {
+	t.Helper()
+	if seccompArch == 0 {
+		t.Skip("seccomp filters are not compiled for this architecture")
+	}
+	filter, err := compileSeccompProfile(&SeccompProfile{DefaultAction: "SCMP_ACT_ERRNO", Syscalls: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
+
+func syscallNr(t *testing.T, name string) uint32 {
+	t.Helper()
+	nr, ok := syscallNumbers[name]
+	if !ok {
+		t.Fatalf("no number for %s", name)
+	}
+	return uint32(nr)
+}
+
+func TestCompileArgCheck(t *testing.T) {
+	const high = 1 << 32
+	tests := []struct {
+		op          string
+		value, two  uint64
+		arg         uint64
+		shouldMatch bool
+	}{
+		{"SCMP_CMP_EQ", 5, 0, 5, true},
+		{"SCMP_CMP_EQ", 5, 0, 6, false},
+		{"SCMP_CMP_EQ", 5, 0, high + 5, false},
+		{"SCMP_CMP_NE", 5, 0, 5, false},
+		{"SCMP_CMP_NE", 5, 0, 6, true},
+		{"SCMP_CMP_NE", 5, 0, high + 5, true},
+		{"SCMP_CMP_MASKED_EQ", 0xff, 0x12, 0x3412, true},
+		{"SCMP_CMP_MASKED_EQ", 0xff, 0x12, 0x3413, false},
+		{"SCMP_CMP_MASKED_EQ", high | 0xff, high | 0x12, 0x12, false},
+		{"SCMP_CMP_GT", 5, 0, 6, true},
+		{"SCMP_CMP_GT", 5, 0, 5, false},
+		{"SCMP_CMP_GT", high + 5, 0, high + 4, false},
+		{"SCMP_CMP_GT", 5, 0, high, true},
+		{"SCMP_CMP_GE", 5, 0, 5, true},
+		{"SCMP_CMP_GE", 5, 0, 4, false},
+		{"SCMP_CMP_GE", high, 0, high - 1, false},
+		{"SCMP_CMP_LT", 5, 0, 4, true},
+		{"SCMP_CMP_LT", 5, 0, 5, false},
+		{"SCMP_CMP_LT", high, 0, high - 1, true},
+		{"SCMP_CMP_LT", 5, 0, high + 1, false},
+		{"SCMP_CMP_LE", 5, 0, 5, true},
+		{"SCMP_CMP_LE", 5, 0, 6, false},
+		{"SCMP_CMP_LE", high + 5, 0, high + 5, true},
+	}
+
+	for _, tt := range tests {
+		// On the second argument so offsets past the first one are covered too
+		filter := compileTestProfile(t, SeccompSyscall{
+			Names:  []string{"personality"},
+			Action: "SCMP_ACT_ALLOW",
+			Args:   []SeccompArg{{Index: 1, Value: tt.value, ValueTwo: tt.two, Op: tt.op}},
+		})
+		data := seccompData{nr: syscallNr(t, "personality"), arch: seccompArch}
+		data.args[1] = tt.arg
+
+		want := testRetDeny
+		if tt.shouldMatch {
+			want = testRetAllow
+		}
+		if got := runBPF(t, filter, data); got != want {
+			t.Errorf("%s %#x (%#x) against %#x: got %#x, want %#x", tt.op, tt.value, tt.two, tt.arg, got, want)
+		}
+	}
+}
+
+func TestCompileSyscallList(t *testing.T) {
+	// More names than fit in one chunk, so the jumps of several chunks are exercised
+	var names []string
+	for name := range syscallNumbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	allowed, denied := names[:len(names)-20], names[len(names)-20:]
+
+	filter := compileTestProfile(t, SeccompSyscall{Names: allowed, Action: "SCMP_ACT_ALLOW"})
+	for _, name := range allowed {
+		if got := runBPF(t, filter, seccompData{nr: syscallNr(t, name), arch: seccompArch}); got != testRetAllow {
+			t.Errorf("%s: got %#x, want allow", name, got)
+		}
+	}
+	for _, name := range denied {
+		if got := runBPF(t, filter, seccompData{nr: syscallNr(t, name), arch: seccompArch}); got != testRetDeny {
+			t.Errorf("%s: got %#x, want the default action", name, got)
+		}
+	}
+}
+
+func TestCompileSeccompRuleOrder(t *testing.T) {
+	// A rule whose arguments don't match has to jump exactly to the next rule
+	filter := compileTestProfile(t,
+		SeccompSyscall{Names: []string{"personality"}, Action: "SCMP_ACT_ALLOW",
+			Args: []SeccompArg{{Index: 0, Value: 0, Op: "SCMP_CMP_EQ"}, {Index: 2, Value: 9, Op: "SCMP_CMP_LE"}}},
+		SeccompSyscall{Names: []string{"personality"}, Action: "SCMP_ACT_KILL_PROCESS",
+			Args: []SeccompArg{{Index: 0, Value: 1, Op: "SCMP_CMP_EQ"}}},
+		SeccompSyscall{Names: []string{"getpid", "personality"}, Action: "SCMP_ACT_LOG"},
+		SeccompSyscall{Names: []string{"personality"}, Action: "SCMP_ACT_ALLOW"},
+	)
+	personality := syscallNr(t, "personality")
+
+	tests := []struct {
+		name string
+		data seccompData
+		want uint32
+	}{
+		{"first rule", seccompData{nr: personality, arch: seccompArch, args: [6]uint64{0, 0, 9}}, testRetAllow},
+		{"second argument fails", seccompData{nr: personality, arch: seccompArch, args: [6]uint64{0, 0, 10}}, unix.SECCOMP_RET_LOG},
+		{"second rule", seccompData{nr: personality, arch: seccompArch, args: [6]uint64{1}}, testRetKill},
+		{"list rule", seccompData{nr: syscallNr(t, "getpid"), arch: seccompArch}, unix.SECCOMP_RET_LOG},
+		{"default action", seccompData{nr: syscallNr(t, "read"), arch: seccompArch}, testRetDeny},
+		{"foreign architecture", seccompData{nr: personality, arch: seccompArch + 1}, testRetKill},
+	}
+	if x32SyscallBit != 0 {
+		tests = append(tests, struct {
+			name string
+			data seccompData
+			want uint32
+		}{"x32 system call", seccompData{nr: personality | x32SyscallBit, arch: seccompArch}, testRetKill})
+	}
+
+	for _, tt := range tests {
+		if got := runBPF(t, filter, tt.data); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileDefaultSeccompProfile(t *testing.T) {
+	profile := resolveSeccompProfile(defaultSeccompProfile(), DefaultCapabilities)
+	filter := compileTestProfile(t, profile.Syscalls...)
+
+	for _, name := range []string{"read", "write", "openat", "clone", "execve", "exit_group"} {
+		if got := runBPF(t, filter, seccompData{nr: syscallNr(t, name), arch: seccompArch}); got != testRetAllow {
+			t.Errorf("%s: got %#x, want allow", name, got)
+		}
+	}
+	for _, name := range []string{"mount", "kexec_load", "init_module", "bpf"} {
+		if got := runBPF(t, filter, seccompData{nr: syscallNr(t, name), arch: seccompArch}); got != testRetDeny {
+			t.Errorf("%s: got %#x, want EPERM", name, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const stateFileName = "state.json"
+
+// saveState writes the container's state file inside its directory
+func saveState(c Container) error {
+	unlock, err := lockState(c.Location)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer unlock()
+	return writeState(c)
+}
+
+// updateState changes the container's state file in place. The monitor records exits this way,
+// so nothing written by the manager in the meantime is lost.
+func updateState(containerDir string, update func(c *Container)) error {
+	unlock, err := lockState(containerDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c, err := loadState(containerDir)
+	if err != nil {
+		return err
+	}
+	update(&c)
+	return writeState(c)
+}
+
+// lockState takes the lock of a container's state, a flock on the container directory itself
+func lockState(containerDir string) (func(), error) {
+	dir, err := os.Open(containerDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return func() { dir.Close() }, nil
+}
+
+// writeState writes the state file with the lock held.
+// The file is written to a temporary name first and renamed so a crash never leaves a torn file behind.
+func writeState(c Container) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(c.Location, stateFileName)
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// loadState reads a container's state file from its directory
+func loadState(containerDir string) (Container, error) {
+	var c Container
+
+	data, err := os.ReadFile(filepath.Join(containerDir, stateFileName))
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("corrupt state file in %s: %w", containerDir, err)
+	}
+	return c, nil
+}
+
+// LoadContainers reloads the containers left under the containers directory by a previous manager.
+// Containers whose init process is gone (or whose PID now belongs to another process) are marked as stopped.
+func LoadContainers() {
+	entries, err := os.ReadDir(ContainersRoot)
+	if err != nil {
+		// Nothing has been launched yet
+		return
+	}
+
+	ContainersRunning = []Container{}
+	ContainersStarting = []Container{}
+	ContainerStopped = []Container{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		c, err := loadState(filepath.Join(ContainersRoot, entry.Name()))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("Warning: %v\n", err)
+			}
+			continue
+		}
+
+		// Normally the monitor has marked it as stopped already, together with its exit status
+		if c.Status != StatusStopped && !containerAlive(c) {
+			err := updateState(c.Location, func(current *Container) {
+				current.Status = StatusStopped
+				c = *current
+			})
+			if err != nil {
+				fmt.Printf("Warning: could not update state of %s: %v\n", c.Name, err)
+			}
+		}
+
+		switch c.Status {
+		case StatusRunning:
+			ContainersRunning = append(ContainersRunning, c)
+		case StatusStarting:
+			ContainersStarting = append(ContainersStarting, c)
+		default:
+			ContainerStopped = append(ContainerStopped, c)
+		}
+	}
+}
+
+// containerAlive reports whether the container's init process still exists.
+// The process start time is compared as well so a recycled PID is not mistaken for the container.
+func containerAlive(c Container) bool {
+	return c.NamespacePID > 0 && processAlive(c.NamespacePID, c.StartTime)
+}
+
+// processStartTime returns the start time of a process in clock ticks since boot (field 22 of /proc/<pid>/stat)
+func processStartTime(pid int) (uint64, error) {
+	_, startTime, err := processStat(pid)
+	return startTime, err
+}
+
+// processStat returns the state (R, S, Z...) and the start time of a process from /proc/<pid>/stat
+func processStat(pid int) (byte, uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The command name may contain spaces and parentheses, so start after the last ')'
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	// Fields after the command name start at field 3 (state)
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	return fields[0][0], startTime, err
+}
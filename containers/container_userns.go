@@ -0,0 +1,208 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultIDMap is the mapping used when a user namespace is requested without explicit ranges
+var DefaultIDMap = IDMap{ContainerID: 0, HostID: 100000, Size: 65536}
+
+// ParseIDMap parses a "containerID:hostID:size" mapping
+func ParseIDMap(s string) (IDMap, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("invalid mapping %q, expected containerID:hostID:size", s)
+	}
+
+	var values [3]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return IDMap{}, fmt.Errorf("invalid mapping %q: %q is not a valid ID", s, part)
+		}
+		values[i] = v
+	}
+	if values[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid mapping %q: size must be positive", s)
+	}
+
+	return IDMap{ContainerID: values[0], HostID: values[1], Size: values[2]}, nil
+}
+
+// SubIDMappings builds a multi-range user namespace from the subordinate IDs of a user
+// in /etc/subuid and /etc/subgid. Ranges are mapped back to back starting at container ID 0.
+func SubIDMappings(username string) (*UserNamespace, error) {
+	names := []string{username}
+	if u, err := user.Lookup(username); err == nil {
+		names = append(names, u.Uid)
+	}
+
+	uidMaps, err := readSubIDFile("/etc/subuid", names)
+	if err != nil {
+		return nil, err
+	}
+	gidMaps, err := readSubIDFile("/etc/subgid", names)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserNamespace{UIDMappings: uidMaps, GIDMappings: gidMaps}, nil
+}
+
+// readSubIDFile reads the ranges of a subuid/subgid file belonging to any of the names
+func readSubIDFile(path string, names []string) ([]IDMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var maps []IDMap
+	containerID := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Format: name:start:count
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || !containsString(names, parts[0]) {
+			continue
+		}
+
+		start, err1 := strconv.Atoi(parts[1])
+		count, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || count <= 0 {
+			return nil, fmt.Errorf("malformed line in %s: %q", path, line)
+		}
+
+		maps = append(maps, IDMap{ContainerID: containerID, HostID: start, Size: count})
+		containerID += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if len(maps) == 0 {
+		return nil, fmt.Errorf("no subordinate IDs for %s in %s", names[0], path)
+	}
+	return maps, nil
+}
+
+// validateUserNamespace checks the mappings are usable: container root mapped and no overlaps
+func validateUserNamespace(userNS *UserNamespace) error {
+	for _, set := range []struct {
+		kind string
+		maps []IDMap
+	}{
+		{"uid", userNS.UIDMappings},
+		{"gid", userNS.GIDMappings},
+	} {
+		if len(set.maps) == 0 {
+			return fmt.Errorf("no %s mappings given", set.kind)
+		}
+		if _, ok := mapToHost(0, set.maps); !ok {
+			return fmt.Errorf("%s mappings must include container ID 0", set.kind)
+		}
+
+		for i, a := range set.maps {
+			for _, b := range set.maps[i+1:] {
+				if rangesOverlap(a.ContainerID, b.ContainerID, a.Size, b.Size) ||
+					rangesOverlap(a.HostID, b.HostID, a.Size, b.Size) {
+					return fmt.Errorf("%s mappings %v and %v overlap", set.kind, a, b)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mapToHost translates a container ID to the host ID it is backed by
+func mapToHost(id int, maps []IDMap) (int, bool) {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + (id - m.ContainerID), true
+		}
+	}
+	return 0, false
+}
+
+// chownToUserNamespace shifts the ownership of every file under root into the user namespace's host ranges,
+// so that files owned by root in the image are owned by root inside the container.
+func chownToUserNamespace(root string, userNS *UserNamespace, out io.Writer) error {
+	unmapped := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		uid, uidOK := mapToHost(int(stat.Uid), userNS.UIDMappings)
+		gid, gidOK := mapToHost(int(stat.Gid), userNS.GIDMappings)
+		if !uidOK || !gidOK {
+			// Left as is, it will show up as the overflow ID inside the container
+			unmapped++
+			return nil
+		}
+
+		// Lchown resets setuid/setgid bits, so restore the mode afterwards
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+		if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && info.Mode()&os.ModeSymlink == 0 {
+			return os.Chmod(path, info.Mode())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to chown %s: %w", root, err)
+	}
+
+	if unmapped > 0 {
+		fmt.Fprintf(out, "Warning: %d files in %s are owned by IDs outside the user namespace mappings\n", unmapped, root)
+	}
+	return nil
+}
+
+// toSysProcIDMap converts mappings to the form used by SysProcAttr
+func toSysProcIDMap(maps []IDMap) []syscall.SysProcIDMap {
+	result := make([]syscall.SysProcIDMap, len(maps))
+	for i, m := range maps {
+		result[i] = syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size}
+	}
+	return result
+}
+
+func rangesOverlap(startA, startB, sizeA, sizeB int) bool {
+	return startA < startB+sizeB && startB < startA+sizeA
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
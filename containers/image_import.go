@@ -0,0 +1,546 @@
+package container
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Media types of the OCI image format, and the Docker ones they replaced
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Annotation holding the reference of a manifest in an OCI layout's index
+const annotationRefName = "org.opencontainers.image.ref.name"
+
+// ImageConfig is the part of an image's config that describes how to run it
+type ImageConfig struct {
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+	User       string   `json:"User,omitempty"`
+}
+
+// imageConfigFile is the OCI image configuration, as far as it is needed here
+type imageConfigFile struct {
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Config       ImageConfig `json:"config"`
+	RootFS       struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// descriptor points at a blob by digest
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// imageIndexManifest is an OCI index or Docker manifest list
+type imageIndexManifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// imageManifest is an OCI or Docker v2 image manifest
+type imageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// dockerSaveManifest is an entry of the manifest.json written by `docker save`
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// importedLayer is a layer file along with the digests it has to match
+type importedLayer struct {
+	path   string
+	digest string // of the file as stored, empty when unknown
+	diffID string // of the uncompressed tar
+}
+
+// importSource is one image found in an OCI layout or docker-save archive
+type importSource struct {
+	refs       []string
+	configPath string
+	config     []byte
+	layers     []importedLayer
+}
+
+// ImportImage imports the images of an OCI image layout or a `docker save` tarball into the store.
+// The path may be a directory or a (gzip compressed) tar of either. With ref set the image is
+// tagged with it instead of the references found in the archive.
+func ImportImage(path, ref string) ([]Image, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path
+	if !info.IsDir() {
+		// Blobs are read by path, so the archive is unpacked next to the store first
+		if dir, err = newImageStaging(); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		fmt.Printf("Unpacking %s..\n", path)
+		if err := extractArchive(path, dir); err != nil {
+			return nil, fmt.Errorf("failed to unpack %s: %w", path, err)
+		}
+	}
+
+	var sources []importSource
+	switch {
+	case fileExists(dir, "index.json"):
+		sources, err = readOCILayout(dir)
+	case fileExists(dir, "manifest.json"):
+		sources, err = readDockerSave(dir)
+	default:
+		err = fmt.Errorf("%s is neither an OCI image layout nor a docker save archive", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no images found in %s", path)
+	}
+
+	if ref != "" {
+		if len(sources) > 1 {
+			return nil, fmt.Errorf("%s holds %d images, a name can only be given for a single one", path, len(sources))
+		}
+		sources[0].refs = []string{ref}
+	}
+
+	var images []Image
+	for _, source := range sources {
+		imported, err := importSourceImage(source)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, imported...)
+	}
+	return images, nil
+}
+
+// importSourceImage verifies and applies the layers of one image and registers it under its references
+func importSourceImage(source importSource) ([]Image, error) {
+	if len(source.refs) == 0 {
+		return nil, fmt.Errorf("image %s has no name, pass one to import it", filepath.Base(source.configPath))
+	}
+	for _, ref := range source.refs {
+		if _, _, err := ParseImageReference(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	var config imageConfigFile
+	if err := json.Unmarshal(source.config, &config); err != nil {
+		return nil, fmt.Errorf("invalid image config: %w", err)
+	}
+	if config.Architecture != "" && config.Architecture != runtime.GOARCH {
+		fmt.Printf("Warning: image %s is built for %s, not %s\n", source.refs[0], config.Architecture, runtime.GOARCH)
+	}
+	if len(config.RootFS.DiffIDs) != len(source.layers) {
+		return nil, fmt.Errorf("image config lists %d layers, the manifest %d", len(config.RootFS.DiffIDs), len(source.layers))
+	}
+
+	staging, err := newImageStaging()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	rootfs := filepath.Join(staging, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return nil, err
+	}
+
+	for i, layer := range source.layers {
+		layer.diffID = config.RootFS.DiffIDs[i]
+		fmt.Printf("Applying layer %d/%d (%s)\n", i+1, len(source.layers), shortDigest(layer.diffID))
+		if err := importLayer(rootfs, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	// The config digest identifies the image
+	configDigest := sha256.Sum256(source.config)
+	id := hex.EncodeToString(configDigest[:])
+	if err := os.WriteFile(filepath.Join(staging, "config.json"), source.config, 0644); err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	for _, ref := range source.refs {
+		name, tag, _ := ParseImageReference(ref)
+		img := Image{ID: id, Name: name, Tag: tag, Created: time.Now(), Config: &config.Config}
+		// registerImage moves staging into place the first time, later references reuse the stored image
+		registered, err := registerImage(img, staging)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, registered)
+	}
+	return images, nil
+}
+
+// importLayer checks the digests of a layer and then applies it to rootfs. Nothing is extracted
+// before both matched, the content of a layer is only trusted once it is known to be the right one.
+func importLayer(rootfs string, layer importedLayer) error {
+	file, err := os.Open(layer.path)
+	if err != nil {
+		return fmt.Errorf("missing layer: %w", err)
+	}
+	defer file.Close()
+
+	if layer.digest != "" {
+		if err := checkReaderDigest(layer.digest, file); err != nil {
+			return fmt.Errorf("layer %s: %w", filepath.Base(layer.path), err)
+		}
+	}
+
+	// The uncompressed digest takes a pass of its own, the layer is read once more to apply it
+	uncompressed, err := openLayerAt(file)
+	if err != nil {
+		return err
+	}
+	if err := checkReaderDigest(layer.diffID, uncompressed); err != nil {
+		return fmt.Errorf("layer %s: %w", filepath.Base(layer.path), err)
+	}
+
+	if uncompressed, err = openLayerAt(file); err != nil {
+		return err
+	}
+	return applyLayer(rootfs, uncompressed)
+}
+
+// openLayerAt rewinds a layer file and returns a reader of its uncompressed tar
+func openLayerAt(file *os.File) (io.Reader, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return openLayer(file)
+}
+
+// checkReaderDigest reads r up to its end and compares the digest of everything read with expected
+func checkReaderDigest(expected string, r io.Reader) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	return checkDigest(expected, h)
+}
+
+// readOCILayout collects the images referenced by the index of an OCI image layout
+func readOCILayout(dir string) ([]importSource, error) {
+	var index imageIndexManifest
+	if err := readJSONFile(dir, "index.json", &index); err != nil {
+		return nil, err
+	}
+
+	var sources []importSource
+	for _, desc := range index.Manifests {
+		manifestDesc := desc
+		// Multi-platform images point at another index, pick the manifest for this machine
+		if desc.MediaType == mediaTypeOCIIndex || desc.MediaType == mediaTypeDockerList {
+			var nested imageIndexManifest
+			if err := readVerifiedJSONBlob(dir, desc, &nested); err != nil {
+				return nil, err
+			}
+			selected, err := selectPlatform(nested.Manifests)
+			if err != nil {
+				return nil, err
+			}
+			manifestDesc = selected
+		}
+
+		var manifest imageManifest
+		if err := readVerifiedJSONBlob(dir, manifestDesc, &manifest); err != nil {
+			return nil, err
+		}
+
+		configPath, err := blobPath(dir, manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		config, err := readVerifiedBlob(dir, manifest.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		source := importSource{configPath: configPath, config: config}
+		// The annotation may only hold a tag, which is not enough to name the image
+		if name := desc.Annotations[annotationRefName]; strings.ContainsAny(name, ":/") {
+			source.refs = []string{name}
+		}
+		for _, layer := range manifest.Layers {
+			path, err := blobPath(dir, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+			source.layers = append(source.layers, importedLayer{path: path, digest: layer.Digest})
+		}
+		sources = append(sources, source)
+	}
+
+	// docker save writes an OCI layout with a manifest.json next to it, which has the full references
+	if fileExists(dir, "manifest.json") {
+		if saved, err := readDockerSave(dir); err == nil {
+			for i := range sources {
+				for _, s := range saved {
+					if s.configPath == sources[i].configPath && len(s.refs) > 0 {
+						sources[i].refs = s.refs
+					}
+				}
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// readDockerSave collects the images listed in the manifest.json of a `docker save` archive
+func readDockerSave(dir string) ([]importSource, error) {
+	var manifests []dockerSaveManifest
+	if err := readJSONFile(dir, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+
+	var sources []importSource
+	for _, m := range manifests {
+		configPath, err := pathInDir(dir, m.Config)
+		if err != nil {
+			return nil, err
+		}
+		config, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("missing image config: %w", err)
+		}
+
+		// The config is named after its digest, either as <hex>.json or as blobs/sha256/<hex>
+		hexDigest := strings.TrimSuffix(filepath.Base(m.Config), ".json")
+		if err := checkDigest("sha256:"+hexDigest, sha256Of(config)); err != nil {
+			return nil, fmt.Errorf("image config %s: %w", m.Config, err)
+		}
+
+		source := importSource{refs: m.RepoTags, configPath: configPath, config: config}
+		for _, layer := range m.Layers {
+			path, err := pathInDir(dir, layer)
+			if err != nil {
+				return nil, err
+			}
+			// Only the uncompressed digests from the config are known for these
+			source.layers = append(source.layers, importedLayer{path: path})
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// selectPlatform picks the manifest for this machine from a multi-platform index
+func selectPlatform(manifests []descriptor) (descriptor, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return m, nil
+		}
+	}
+	return descriptor{}, fmt.Errorf("no image for linux/%s in the index", runtime.GOARCH)
+}
+
+// blobPath returns the path of a blob in an OCI layout
+func blobPath(dir, digest string) (string, error) {
+	algorithm, hexDigest, found := strings.Cut(digest, ":")
+	if !found || algorithm != "sha256" || len(hexDigest) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return pathInDir(dir, filepath.Join("blobs", algorithm, hexDigest))
+}
+
+// readVerifiedBlob reads a blob and checks it against its descriptor
+func readVerifiedBlob(dir string, desc descriptor) ([]byte, error) {
+	path, err := blobPath(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("missing blob: %w", err)
+	}
+	if desc.Size > 0 && int64(len(data)) != desc.Size {
+		return nil, fmt.Errorf("blob %s: expected %d bytes, got %d", shortDigest(desc.Digest), desc.Size, len(data))
+	}
+	if err := checkDigest(desc.Digest, sha256Of(data)); err != nil {
+		return nil, fmt.Errorf("blob %s: %w", shortDigest(desc.Digest), err)
+	}
+	return data, nil
+}
+
+func readVerifiedJSONBlob(dir string, desc descriptor, v any) error {
+	data, err := readVerifiedBlob(dir, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func readJSONFile(dir, name string, v any) error {
+	path, err := pathInDir(dir, name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
+
+// pathInDir resolves a path found in an archive's metadata inside dir. Links in the unpacked
+// archive are followed as if dir was the root, so neither they nor ".." can lead out of it.
+func pathInDir(dir, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty path in archive")
+	}
+	return resolveInRootFollow(dir, name)
+}
+
+func fileExists(dir, name string) bool {
+	path, err := pathInDir(dir, name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func sha256Of(data []byte) hash.Hash {
+	h := sha256.New()
+	h.Write(data)
+	return h
+}
+
+// checkDigest compares a sha256:<hex> digest with a finished hash
+func checkDigest(expected string, h hash.Hash) error {
+	actual := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if expected != actual {
+		return fmt.Errorf("digest mismatch, expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// shortDigest abbreviates a digest for progress output
+func shortDigest(digest string) string {
+	_, hexDigest, _ := strings.Cut(digest, ":")
+	if len(hexDigest) > 12 {
+		return hexDigest[:12]
+	}
+	return hexDigest
+}
+
+// extractArchive unpacks a plain or gzip compressed tar of an image layout into dir
+func extractArchive(path, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := openLayer(file)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only files, directories and links make up an image layout
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+
+		// Links unpacked before are followed inside dir, however they are chained
+		target, err := resolveInRoot(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == dir {
+			continue
+		}
+		// Anything in the way is replaced, so nothing is ever written through an existing link
+		if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Older docker save archives link identical layers to each other, within the archive
+			dest := filepath.Join(filepath.Dir(target), hdr.Linkname)
+			if rel, err := filepath.Rel(dir, dest); filepath.IsAbs(hdr.Linkname) || err != nil || strings.HasPrefix(rel, "..") {
+				return fmt.Errorf("invalid link %s in archive", hdr.Name)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
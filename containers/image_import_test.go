@@ -0,0 +1,395 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// tarEntry is one entry of a tar fixture, a directory when name ends with a slash
+type tarEntry struct {
+	name string
+	data string
+	link string // symlink target
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Uid: os.Getuid(), Gid: os.Getgid()}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		default:
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(e.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func applyLayers(t *testing.T, rootfs string, layers ...[]tarEntry) {
+	t.Helper()
+	for _, layer := range layers {
+		if err := applyLayer(rootfs, bytes.NewReader(buildTar(t, layer))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertExists(t *testing.T, path string, exists bool) {
+	t.Helper()
+	_, err := os.Lstat(path)
+	if exists && err != nil {
+		t.Errorf("%s is missing: %v", path, err)
+	}
+	if !exists && err == nil {
+		t.Errorf("%s should not exist", path)
+	}
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	rootfs := t.TempDir()
+	applyLayers(t, rootfs, []tarEntry{
+		{name: "etc/"},
+		{name: "etc/keep", data: "keep"},
+		{name: "etc/gone", data: "gone"},
+		{name: "var/cache/"},
+		{name: "var/cache/a", data: "a"},
+		{name: "var/cache/sub/b", data: "b"},
+	}, []tarEntry{
+		{name: "etc/.wh.gone"},
+		{name: "var/cache/new", data: "new"},
+		{name: "var/cache/.wh..wh..opq"},
+	})
+
+	assertExists(t, filepath.Join(rootfs, "etc/keep"), true)
+	assertExists(t, filepath.Join(rootfs, "etc/gone"), false)
+	assertExists(t, filepath.Join(rootfs, "etc/.wh.gone"), false)
+	assertExists(t, filepath.Join(rootfs, "var/cache/a"), false)
+	assertExists(t, filepath.Join(rootfs, "var/cache/sub"), false)
+	assertExists(t, filepath.Join(rootfs, "var/cache/.wh..wh..opq"), false)
+	// Created by the layer holding the opaque whiteout, which only hides what was below
+	assertExists(t, filepath.Join(rootfs, "var/cache/new"), true)
+}
+
+func TestApplyLayerStaysInRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "precious"), []byte("precious"))
+
+	rootfs := t.TempDir()
+	applyLayers(t, rootfs, []tarEntry{
+		{name: "a", link: outside},
+		{name: "b", link: "../../../../../../../../" + outside},
+	}, []tarEntry{
+		{name: "a/.wh..wh..opq"},
+		{name: "b/.wh..wh..opq"},
+		{name: "a/.wh.precious"},
+		{name: "b/evil", data: "evil"},
+	})
+
+	assertExists(t, filepath.Join(outside, "precious"), true)
+	assertExists(t, filepath.Join(outside, "evil"), false)
+	// The links are followed as if rootfs was /
+	assertExists(t, filepath.Join(rootfs, outside, "evil"), true)
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "layout")
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	writeFile(t, archive, buildTar(t, []tarEntry{
+		{name: "blobs/sha256/"},
+		{name: "blobs/sha256/a", data: "a"},
+		{name: "blobs/sha256/b", link: "a"},
+		{name: "replaced", link: "blobs/sha256/a"},
+		{name: "replaced", data: "file"},
+	}))
+	if err := extractArchive(archive, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "blobs/sha256/b")); err != nil || string(data) != "a" {
+		t.Errorf("link b reads %q, %v", data, err)
+	}
+	// The file replaces the link instead of being written through it
+	if info, err := os.Lstat(filepath.Join(dir, "replaced")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("replaced is not a regular file: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "blobs/sha256/a")); string(data) != "a" {
+		t.Errorf("a was overwritten with %q", data)
+	}
+}
+
+func TestExtractArchiveStaysInDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"absolute link", []tarEntry{{name: "l", link: "/"}}},
+		{"dot-dot link", []tarEntry{{name: "d/l", link: "../.."}}},
+		{"chained links", []tarEntry{
+			{name: "x/y/"},
+			{name: "x/y/z", link: "../.."},
+			{name: "x/y/z/l", link: "../.."},
+			{name: "x/y/z/l/evil", data: "evil"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			archive := filepath.Join(t.TempDir(), "image.tar")
+			writeFile(t, archive, buildTar(t, tt.entries))
+
+			if err := extractArchive(archive, filepath.Join(parent, "layout")); err == nil {
+				t.Error("the archive was extracted")
+			}
+			assertExists(t, filepath.Join(parent, "evil"), false)
+		})
+	}
+}
+
+func TestExtractArchiveLinkedDirectory(t *testing.T) {
+	// A file below a link to a directory lands inside dir, wherever the link points
+	dir := filepath.Join(t.TempDir(), "layout")
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	writeFile(t, archive, buildTar(t, []tarEntry{
+		{name: "x/y/"},
+		{name: "x/y/z", link: "../.."},
+		{name: "x/y/z/file", data: "file"},
+	}))
+	if err := extractArchive(archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, filepath.Join(dir, "file"), true)
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		ref, name, tag string
+	}{
+		{"alpine", "alpine", DefaultImageTag},
+		{"alpine:3.19", "alpine", "3.19"},
+		{"library/alpine", "library/alpine", DefaultImageTag},
+		{"localhost:5000/app", "localhost:5000/app", DefaultImageTag},
+		{"registry.example.com:443/team/app:v1.2", "registry.example.com:443/team/app", "v1.2"},
+		{"ghcr.io/owner/app", "ghcr.io/owner/app", DefaultImageTag},
+	}
+	for _, tt := range tests {
+		name, tag, err := ParseImageReference(tt.ref)
+		if err != nil {
+			t.Errorf("%s: %v", tt.ref, err)
+			continue
+		}
+		if name != tt.name || tag != tt.tag {
+			t.Errorf("%s: got %s and %s, want %s and %s", tt.ref, name, tag, tt.name, tt.tag)
+		}
+	}
+
+	for _, ref := range []string{"", "Alpine", "alpine:", "alpine:-x", "a//b", "app/"} {
+		if _, _, err := ParseImageReference(ref); err == nil {
+			t.Errorf("%q was accepted", ref)
+		}
+	}
+}
+
+// imageFixture is a single layer image written out as an OCI layout or a docker save archive
+type imageFixture struct {
+	layer  []byte // gzip compressed
+	diffID string
+	config []byte
+}
+
+func newImageFixture(t *testing.T) imageFixture {
+	t.Helper()
+	layer := buildTar(t, []tarEntry{{name: "etc/"}, {name: "etc/hostname", data: "fixture\n"}})
+	fixture := imageFixture{layer: gzipBytes(t, layer), diffID: digestOf(layer)}
+
+	var config imageConfigFile
+	config.Architecture, config.OS = runtime.GOARCH, "linux"
+	config.Config.Cmd = []string{"/bin/sh"}
+	config.RootFS.DiffIDs = []string{fixture.diffID}
+	fixture.config = mustJSON(t, config)
+	return fixture
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeBlob(t *testing.T, dir string, data []byte) descriptor {
+	t.Helper()
+	digest := digestOf(data)
+	writeFile(t, filepath.Join(dir, "blobs", "sha256", digest[len("sha256:"):]), data)
+	return descriptor{Digest: digest, Size: int64(len(data))}
+}
+
+func (f imageFixture) writeOCILayout(t *testing.T, dir, ref string) {
+	t.Helper()
+	manifest := imageManifest{MediaType: mediaTypeOCIManifest, Config: writeBlob(t, dir, f.config)}
+	manifest.Layers = []descriptor{writeBlob(t, dir, f.layer)}
+
+	desc := writeBlob(t, dir, mustJSON(t, manifest))
+	desc.MediaType = mediaTypeOCIManifest
+	desc.Annotations = map[string]string{annotationRefName: ref}
+	writeFile(t, filepath.Join(dir, "index.json"), mustJSON(t, imageIndexManifest{Manifests: []descriptor{desc}}))
+}
+
+func (f imageFixture) writeDockerSave(t *testing.T, dir, ref string) {
+	t.Helper()
+	configName := digestOf(f.config)[len("sha256:"):] + ".json"
+	writeFile(t, filepath.Join(dir, configName), f.config)
+	writeFile(t, filepath.Join(dir, "0123/layer.tar"), f.layer)
+	writeFile(t, filepath.Join(dir, "manifest.json"), mustJSON(t, []dockerSaveManifest{
+		{Config: configName, RepoTags: []string{ref}, Layers: []string{"0123/layer.tar"}},
+	}))
+}
+
+func useTempStore(t *testing.T) {
+	t.Helper()
+	saved := ImagesRoot
+	ImagesRoot = t.TempDir()
+	t.Cleanup(func() { ImagesRoot = saved })
+}
+
+func TestImportImageLayouts(t *testing.T) {
+	fixture := newImageFixture(t)
+	tests := []struct {
+		name  string
+		ref   string
+		write func(t *testing.T, dir, ref string)
+	}{
+		{"oci layout", "test/oci:v1", fixture.writeOCILayout},
+		{"docker save", "test/save:v2", fixture.writeDockerSave},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempStore(t)
+			dir := t.TempDir()
+			tt.write(t, dir, tt.ref)
+
+			images, err := ImportImage(dir, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != 1 || images[0].Reference() != tt.ref {
+				t.Fatalf("imported %+v, want %s", images, tt.ref)
+			}
+			if images[0].ID != digestOf(fixture.config)[len("sha256:"):] {
+				t.Errorf("image ID %s is not the config digest", images[0].ID)
+			}
+			if data, err := os.ReadFile(filepath.Join(imageRootfs(images[0].ID), "etc/hostname")); err != nil || string(data) != "fixture\n" {
+				t.Errorf("etc/hostname holds %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestImportImageArchive(t *testing.T) {
+	useTempStore(t)
+	fixture := newImageFixture(t)
+	dir := t.TempDir()
+	fixture.writeDockerSave(t, dir, "test/archive:v1")
+
+	// Older docker save archives link identical layers to each other
+	configName := digestOf(fixture.config)[len("sha256:"):] + ".json"
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	writeFile(t, archive, gzipBytes(t, buildTar(t, []tarEntry{
+		{name: configName, data: string(fixture.config)},
+		{name: "0123/layer.tar", data: string(fixture.layer)},
+		{name: "4567/layer.tar", link: "../0123/layer.tar"},
+		{name: "manifest.json", data: string(mustJSON(t, []dockerSaveManifest{
+			{Config: configName, RepoTags: []string{"test/archive:v1"}, Layers: []string{"4567/layer.tar"}},
+		}))},
+	})))
+
+	images, err := ImportImage(archive, "test/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Reference() != "test/renamed:"+DefaultImageTag {
+		t.Fatalf("imported %+v", images)
+	}
+}
+
+func TestImportImageDigestMismatch(t *testing.T) {
+	useTempStore(t)
+	fixture := newImageFixture(t)
+	// The config promises other content than the layer holds
+	evil := buildTar(t, []tarEntry{{name: "evil", data: "evil"}})
+	fixture.layer = gzipBytes(t, evil)
+
+	dir := t.TempDir()
+	fixture.writeDockerSave(t, dir, "test/mismatch:v1")
+	if _, err := ImportImage(dir, ""); err == nil {
+		t.Fatal("an image with a wrong layer was imported")
+	}
+
+	// Nothing was extracted, the staging directory is gone again
+	entries, _ := os.ReadDir(ImagesRoot)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("%s was left in the store", entry.Name())
+		}
+	}
+}
+
+func TestImportImageUnknownLayout(t *testing.T) {
+	useTempStore(t)
+	if _, err := ImportImage(t.TempDir(), ""); err == nil {
+		t.Fatal("an empty directory was imported")
+	}
+}
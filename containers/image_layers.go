@@ -0,0 +1,264 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whiteout markers of the OCI image layer format
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Maximum number of symlinks followed while resolving a path inside a root filesystem
+const maxSymlinkHops = 255
+
+// resolveInRoot resolves path as if root was the root directory: absolute symlinks and ".." can't
+// leave root. The last component is not followed when it is a symlink.
+func resolveInRoot(root, path string) (string, error) {
+	return resolveInRootHops(root, path, false, 0)
+}
+
+// resolveInRootFollow is resolveInRoot following a symlink in the last component too
+func resolveInRootFollow(root, path string) (string, error) {
+	return resolveInRootHops(root, path, true, 0)
+}
+
+func resolveInRootHops(root, path string, followLast bool, hops int) (string, error) {
+	parts := strings.Split(filepath.Clean("/"+path), "/")
+	resolved := "/"
+
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		last := i == len(parts)-1
+		if last && !followLast {
+			resolved = next
+			break
+		}
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// Missing components are fine, they are about to be created
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+
+		// Continue with the link target followed by the rest of the path
+		rest := filepath.Join(append([]string{target}, parts[i+1:]...)...)
+		return resolveInRootHops(root, rest, followLast, hops)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// openLayer returns a reader of the uncompressed layer tar, gzip compression is detected from the content
+func openLayer(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("zstd compressed layers are not supported")
+	}
+	return buffered, nil
+}
+
+// applyLayer extracts an uncompressed layer tar on top of rootfs, processing its whiteouts
+func applyLayer(rootfs string, layer io.Reader) error {
+	tr := tar.NewReader(layer)
+	// Paths this layer created, an opaque whiteout only hides what lower layers put in a directory
+	created := map[string]bool{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt layer: %w", err)
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		dir, base := filepath.Split(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			// The directory itself may be a link, which has to be followed inside rootfs and not on the host
+			target, err := resolveInRootFollow(rootfs, dir)
+			if err != nil {
+				return err
+			}
+			if err := removeDirContents(target, rootfs, created); err != nil {
+				return err
+			}
+			continue
+
+		case strings.HasPrefix(base, whiteoutPrefix):
+			target, err := resolveInRoot(rootfs, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target, err := resolveInRoot(rootfs, name)
+		if err != nil {
+			return err
+		}
+		if target == rootfs {
+			continue
+		}
+		if err := extractEntry(rootfs, target, hdr, tr); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		created[target] = true
+	}
+}
+
+// removeDirContents empties dir, apart from entries created by the current layer
+func removeDirContents(dir, rootfs string, created map[string]bool) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// ReadDir would follow a link out of rootfs, dir has to be resolved already
+	if !info.IsDir() {
+		return fmt.Errorf("opaque whiteout in %s, which is not a directory", strings.TrimPrefix(dir, rootfs))
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if created[path] {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractEntry creates a single layer entry at target
+func extractEntry(rootfs, target string, hdr *tar.Header, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Anything in the way is replaced, except a directory by a directory
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		return lchownEntry(target, hdr, os.Symlink(hdr.Linkname, target))
+
+	case tar.TypeLink:
+		source, err := resolveInRoot(rootfs, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devType := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devType = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devType = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(target, devType|mode, int(dev)); err != nil {
+			// Device nodes can't be created without privileges, the container gets its own /dev anyway
+			if Rootless && errors.Is(err, unix.EPERM) {
+				return nil
+			}
+			return err
+		}
+
+	default:
+		// Nothing else is meaningful in a root filesystem
+		return nil
+	}
+
+	if err := lchownEntry(target, hdr, nil); err != nil {
+		return err
+	}
+	// After chown, which clears the setuid and setgid bits
+	if err := unix.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.AccessTime, hdr.ModTime)
+}
+
+// lchownEntry gives target the owner recorded in the layer. Rootless imports keep the calling
+// user as the owner, which is what container root maps to.
+func lchownEntry(target string, hdr *tar.Header, err error) error {
+	if err != nil || Rootless {
+		return err
+	}
+	return os.Lchown(target, hdr.Uid, hdr.Gid)
+}
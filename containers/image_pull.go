@@ -0,0 +1,424 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"malptainer/utils"
+)
+
+// Registry used for references without a registry host, and its API host
+const (
+	defaultRegistry     = "docker.io"
+	defaultRegistryHost = "registry-1.docker.io"
+)
+
+// Manifests are small, anything bigger is not a manifest
+const maxManifestSize = 4 << 20
+
+// pullDownloadsDir keeps blobs being downloaded, so an interrupted pull can resume
+const pullDownloadsDir = ".downloads"
+
+// manifestMediaTypes are accepted when fetching a manifest
+var manifestMediaTypes = []string{mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest}
+
+// registryClient talks to one repository of an OCI distribution registry
+type registryClient struct {
+	baseURL    string
+	repository string
+	client     *http.Client
+	auth       string // Authorization header, once a challenge was answered
+}
+
+// parsePullReference splits a reference like alpine:3 or localhost:5000/tools/app:1 into the
+// registry host, repository and tag. The image is stored under the reference as given.
+func parsePullReference(ref string) (host, repository, tag string, err error) {
+	name, tag, err := ParseImageReference(ref)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	host = defaultRegistry
+	repository = name
+	if first, rest, found := strings.Cut(name, "/"); found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		host, repository = first, rest
+	}
+
+	if host == defaultRegistry {
+		host = defaultRegistryHost
+		// Official images live in the library namespace
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	return host, repository, tag, nil
+}
+
+// newRegistryClient returns a client for a repository. Plain HTTP is used for registries on
+// the local machine and the ones listed in MALPTAINER_INSECURE_REGISTRIES.
+func newRegistryClient(host, repository string) *registryClient {
+	scheme := "https"
+	if insecureRegistry(host) {
+		scheme = "http"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &registryClient{
+		baseURL:    scheme + "://" + host,
+		repository: repository,
+		client:     &http.Client{Transport: transport},
+	}
+}
+
+func insecureRegistry(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, insecure := range strings.Split(os.Getenv("MALPTAINER_INSECURE_REGISTRIES"), ",") {
+		if strings.TrimSpace(insecure) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// get requests a path of the repository, answering an authentication challenge once
+func (r *registryClient) get(path string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, r.baseURL+"/v2/"+r.repository+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate answers a Bearer or Basic challenge. Credentials are taken from
+// MALPTAINER_REGISTRY_USER and MALPTAINER_REGISTRY_PASSWORD, anonymous tokens are used without them.
+func (r *registryClient) authenticate(challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+	user, password := os.Getenv("MALPTAINER_REGISTRY_USER"), os.Getenv("MALPTAINER_REGISTRY_PASSWORD")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if user == "" {
+			return fmt.Errorf("registry requires a login, set MALPTAINER_REGISTRY_USER and MALPTAINER_REGISTRY_PASSWORD")
+		}
+		req, _ := http.NewRequest(http.MethodGet, r.baseURL, nil)
+		req.SetBasicAuth(user, password)
+		r.auth = req.Header.Get("Authorization")
+		return nil
+
+	case "bearer":
+		realm, err := url.Parse(params["realm"])
+		if err != nil || params["realm"] == "" {
+			return fmt.Errorf("invalid authentication challenge %q", challenge)
+		}
+		query := realm.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		scope := params["scope"]
+		if scope == "" {
+			scope = "repository:" + r.repository + ":pull"
+		}
+		query.Set("scope", scope)
+		realm.RawQuery = query.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to get a registry token: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to get a registry token: %s", resp.Status)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return fmt.Errorf("invalid registry token response: %w", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return fmt.Errorf("registry returned an empty token")
+		}
+		r.auth = "Bearer " + token.Token
+		return nil
+	}
+
+	return fmt.Errorf("unsupported registry authentication %q", challenge)
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header like Bearer realm="...",service="..."
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values may contain commas, like scopes with several actions
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(strings.TrimSpace(value[end+2:]), ",")
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
+
+// getManifest fetches a manifest by tag or digest, verifying it when fetched by digest
+func (r *registryClient) getManifest(reference string) ([]byte, string, error) {
+	resp, err := r.get("/manifests/"+reference, http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch manifest %s: %s", reference, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s is too large", reference)
+	}
+
+	if strings.HasPrefix(reference, "sha256:") {
+		if err := checkDigest(reference, sha256Of(data)); err != nil {
+			return nil, "", fmt.Errorf("manifest %s: %w", shortDigest(reference), err)
+		}
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	// Fall back to the media type in the document, some registries send a generic content type
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+	return data, mediaType, nil
+}
+
+// downloadBlob downloads a blob into dir and verifies its digest. An interrupted download
+// is resumed from where it stopped.
+func (r *registryClient) downloadBlob(desc descriptor, dir string) (string, error) {
+	path, err := blobPath(dir, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if verifyBlobFile(path, desc.Digest) == nil {
+		return path, nil
+	}
+
+	partial := path + ".partial"
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := r.get("/blobs/"+desc.Digest, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		fmt.Printf("Resuming %s at %d bytes\n", shortDigest(desc.Digest), offset)
+	case http.StatusOK:
+		// The registry ignored the range, start over
+		if err := file.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Everything was downloaded already, the digest check below decides
+	default:
+		return "", fmt.Errorf("failed to download blob %s: %s", shortDigest(desc.Digest), resp.Status)
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(file, resp.Body); err != nil {
+			return "", fmt.Errorf("download of blob %s interrupted: %w", shortDigest(desc.Digest), err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	if err := verifyBlobFile(partial, desc.Digest); err != nil {
+		os.Remove(partial)
+		return "", fmt.Errorf("blob %s: %w", shortDigest(desc.Digest), err)
+	}
+	return path, os.Rename(partial, path)
+}
+
+// verifyBlobFile checks a downloaded file against its digest
+func verifyBlobFile(path, digest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	return checkDigest(digest, h)
+}
+
+// PullImage downloads an image from its registry into the local image store
+func PullImage(ref string) (Image, error) {
+	host, repository, tag, err := parsePullReference(ref)
+	if err != nil {
+		return Image{}, err
+	}
+	registry := newRegistryClient(host, repository)
+	fmt.Printf("Pulling %s from %s/%s\n", ref, host, repository)
+
+	data, mediaType, err := registry.getManifest(tag)
+	if err != nil {
+		return Image{}, err
+	}
+
+	// Multi-platform images list a manifest per platform
+	if mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerList {
+		var index imageIndexManifest
+		if err := json.Unmarshal(data, &index); err != nil {
+			return Image{}, fmt.Errorf("invalid image index: %w", err)
+		}
+		selected, err := selectPlatform(index.Manifests)
+		if err != nil {
+			return Image{}, err
+		}
+		if data, mediaType, err = registry.getManifest(selected.Digest); err != nil {
+			return Image{}, err
+		}
+	}
+	if mediaType != mediaTypeOCIManifest && mediaType != mediaTypeDockerManifest {
+		return Image{}, fmt.Errorf("unsupported manifest type %q", mediaType)
+	}
+
+	var manifest imageManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Image{}, fmt.Errorf("invalid image manifest: %w", err)
+	}
+
+	downloads := filepath.Join(ImagesRoot, pullDownloadsDir)
+	if err := makeStoreDir(downloads); err != nil {
+		return Image{}, err
+	}
+	configPath, err := registry.downloadBlob(manifest.Config, downloads)
+	if err != nil {
+		return Image{}, err
+	}
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return Image{}, err
+	}
+
+	source := importSource{refs: []string{ref}, configPath: configPath, config: config}
+	for i, layer := range manifest.Layers {
+		fmt.Printf("Downloading layer %d/%d (%s, %s)\n", i+1, len(manifest.Layers), shortDigest(layer.Digest), utils.FormatByteSize(layer.Size))
+		path, err := registry.downloadBlob(layer, downloads)
+		if err != nil {
+			return Image{}, err
+		}
+		source.layers = append(source.layers, importedLayer{path: path, digest: layer.Digest})
+	}
+
+	images, err := importSourceImage(source)
+	if err != nil {
+		return Image{}, err
+	}
+
+	// The blobs are only kept around until the image is in the store
+	os.Remove(configPath)
+	for _, layer := range source.layers {
+		os.Remove(layer.path)
+	}
+	return images[0], nil
+}
@@ -0,0 +1,243 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseAuthChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			"Bearer",
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"},
+		},
+		{
+			// Quoted values may hold commas
+			`Bearer realm="https://r.example/token", scope="repository:a/b:pull,push", service=r.example`,
+			"Bearer",
+			map[string]string{"realm": "https://r.example/token", "scope": "repository:a/b:pull,push", "service": "r.example"},
+		},
+		{`Basic realm="Registry"`, "Basic", map[string]string{"realm": "Registry"}},
+		{`Basic`, "Basic", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		scheme, params := parseAuthChallenge(tt.header)
+		if scheme != tt.scheme || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s: got %s %v, want %s %v", tt.header, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
+
+// testRegistry serves a single multi-platform image behind a token server, the way Docker Hub does
+type testRegistry struct {
+	*httptest.Server
+	t     *testing.T
+	blobs map[string][]byte // by digest
+
+	otherManifest string // digest of the manifest for another platform
+
+	mu          sync.Mutex
+	tokens      int
+	ranges      []string
+	requested   []string
+	corruptBlob string // digest of a blob served with other content
+}
+
+const testRegistryToken = "test-token"
+
+func newTestRegistry(t *testing.T, fixture imageFixture) *testRegistry {
+	r := &testRegistry{t: t, blobs: map[string][]byte{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+
+	config, layer := r.addBlob(fixture.config), r.addBlob(fixture.layer)
+	manifest := r.addBlob(mustJSON(t, imageManifest{
+		MediaType: mediaTypeOCIManifest,
+		Config:    config,
+		Layers:    []descriptor{layer},
+	}))
+	manifest.MediaType = mediaTypeOCIManifest
+
+	// A manifest for another platform comes first, it must not be the one pulled
+	other := r.addBlob([]byte(`{"mediaType":"` + mediaTypeOCIManifest + `","layers":[]}`))
+	other.MediaType = mediaTypeOCIManifest
+	r.otherManifest = other.Digest
+	otherArch := "s390x"
+	if runtime.GOARCH == otherArch {
+		otherArch = "riscv64"
+	}
+	index := imageIndexManifest{
+		MediaType: mediaTypeOCIIndex,
+		Manifests: []descriptor{withPlatform(t, other, otherArch), withPlatform(t, manifest, runtime.GOARCH)},
+	}
+	r.blobs["v1"] = mustJSON(t, index)
+	return r
+}
+
+// withPlatform returns the descriptor of a linux manifest for arch
+func withPlatform(t *testing.T, d descriptor, arch string) descriptor {
+	platform := fmt.Sprintf(`{"architecture":%q,"os":"linux"}`, arch)
+	if err := json.Unmarshal([]byte(platform), &d.Platform); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (r *testRegistry) addBlob(data []byte) descriptor {
+	digest := digestOf(data)
+	r.blobs[digest] = data
+	return descriptor{Digest: digest, Size: int64(len(data))}
+}
+
+// ref returns the reference of the image on this registry
+func (r *testRegistry) ref() string {
+	return strings.TrimPrefix(r.URL, "http://") + "/test/app:v1"
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		query := req.URL.Query()
+		if query.Get("service") != "test-registry" || query.Get("scope") != "repository:test/app:pull" {
+			r.t.Errorf("token requested for %s", req.URL.RawQuery)
+		}
+		r.tokens++
+		fmt.Fprintf(w, `{"token":%q}`, testRegistryToken)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+testRegistryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:test/app:pull"`, r.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	kind, reference, found := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/test/app/"), "/")
+	data, ok := r.blobs[reference]
+	if !found || !ok || (kind != "manifests" && kind != "blobs") {
+		http.NotFound(w, req)
+		return
+	}
+	r.requested = append(r.requested, reference)
+
+	if kind == "manifests" {
+		if reference == "v1" {
+			w.Header().Set("Content-Type", mediaTypeOCIIndex)
+		} else {
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		}
+		w.Write(data)
+		return
+	}
+
+	if reference == r.corruptBlob {
+		data = append([]byte("corrupt"), data[7:]...)
+	}
+	if ranges := req.Header.Get("Range"); ranges != "" {
+		r.ranges = append(r.ranges, ranges)
+		var offset int
+		if _, err := fmt.Sscanf(ranges, "bytes=%d-", &offset); err != nil || offset > len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[offset:])
+		return
+	}
+	w.Write(data)
+}
+
+func TestPullImage(t *testing.T) {
+	useTempStore(t)
+	fixture := newImageFixture(t)
+	registry := newTestRegistry(t, fixture)
+
+	img, err := PullImage(registry.ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Reference() != registry.ref() {
+		t.Errorf("stored as %s", img.Reference())
+	}
+	if data, err := os.ReadFile(filepath.Join(imageRootfs(img.ID), "etc/hostname")); err != nil || string(data) != "fixture\n" {
+		t.Errorf("etc/hostname holds %q, %v", data, err)
+	}
+
+	// The token is fetched once and reused for every request
+	if registry.tokens != 1 {
+		t.Errorf("%d tokens requested", registry.tokens)
+	}
+	for _, requested := range registry.requested {
+		if requested == registry.otherManifest {
+			t.Error("the manifest of another platform was pulled")
+		}
+	}
+}
+
+func TestPullImageResume(t *testing.T) {
+	useTempStore(t)
+	fixture := newImageFixture(t)
+	registry := newTestRegistry(t, fixture)
+
+	// An earlier pull stopped halfway through the layer
+	layerDigest := digestOf(fixture.layer)
+	path, err := blobPath(filepath.Join(ImagesRoot, pullDownloadsDir), layerDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(fixture.layer) / 2
+	writeFile(t, path+".partial", fixture.layer[:half])
+
+	img, err := PullImage(registry.ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("bytes=%d-", half); !reflect.DeepEqual(registry.ranges, []string{want}) {
+		t.Errorf("requested ranges %v, want %s", registry.ranges, want)
+	}
+	if _, err := os.Stat(filepath.Join(imageRootfs(img.ID), "etc/hostname")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPullImageDigestMismatch(t *testing.T) {
+	useTempStore(t)
+	fixture := newImageFixture(t)
+	registry := newTestRegistry(t, fixture)
+	registry.corruptBlob = digestOf(fixture.layer)
+
+	_, err := PullImage(registry.ref())
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("got %v, want a digest mismatch", err)
+	}
+
+	// The corrupt download is not kept for a later resume
+	path, _ := blobPath(filepath.Join(ImagesRoot, pullDownloadsDir), registry.corruptBlob)
+	for _, p := range []string{path, path + ".partial"} {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was kept: %v", p, err)
+		}
+	}
+	if _, err := FindImage(registry.ref()); err == nil {
+		t.Error("the image was stored")
+	}
+}
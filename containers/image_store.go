@@ -0,0 +1,361 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/otiai10/copy"
+	"golang.org/x/sys/unix"
+)
+
+// ImagesRoot is the directory of the local image store, one sub-directory per image
+var ImagesRoot = ".images"
+
+// imageIndexFile maps image references to the images in the store
+const imageIndexFile = "images.json"
+
+// DefaultImageTag is used for references without a tag
+const DefaultImageTag = "latest"
+
+// untaggedImageTag marks images that lost their tag while containers still use them
+const untaggedImageTag = "<none>"
+
+// Image is a root filesystem in the local image store
+type Image struct {
+	ID      string    `json:"id"` // hex encoded sha256
+	Name    string    `json:"name"`
+	Tag     string    `json:"tag"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"` // of the root filesystem, in bytes
+
+	// How to run the image, only known for imported images
+	Config *ImageConfig `json:"config,omitempty"`
+}
+
+// Reference returns the name:tag the image is known by
+func (i Image) Reference() string {
+	return i.Name + ":" + i.Tag
+}
+
+// ShortID returns the abbreviated ID shown in listings
+func (i Image) ShortID() string {
+	if len(i.ID) > 12 {
+		return i.ID[:12]
+	}
+	return i.ID
+}
+
+// imageRootfs returns the root filesystem directory of an image
+func imageRootfs(id string) string {
+	return filepath.Join(ImagesRoot, id, "rootfs")
+}
+
+var imageNamePattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// ParseImageReference splits a name[:tag] reference, the tag defaults to latest
+func ParseImageReference(ref string) (string, string, error) {
+	name, tag := ref, DefaultImageTag
+	// A colon after the last slash separates the tag, one before it belongs to a registry port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+
+	if !imageNamePattern.MatchString(registryPath(name)) {
+		return "", "", fmt.Errorf("invalid image name %q", name)
+	}
+	if !imageTagPattern.MatchString(tag) {
+		return "", "", fmt.Errorf("invalid image tag %q", tag)
+	}
+	return name, tag, nil
+}
+
+// registryPath strips a leading registry host (one with a dot, a port or localhost) from an image name
+func registryPath(name string) string {
+	host, path, found := strings.Cut(name, "/")
+	if found && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		return path
+	}
+	return name
+}
+
+type imageIndex struct {
+	Images []Image `json:"images"`
+}
+
+// withImageIndex runs fn with the image index loaded and locked, and saves it afterwards
+func withImageIndex(fn func(index *imageIndex) error) error {
+	if err := makeStoreDir(ImagesRoot); err != nil {
+		return err
+	}
+
+	path := filepath.Join(ImagesRoot, imageIndexFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open image index: %w", err)
+	}
+	defer file.Close()
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock image index: %w", err)
+	}
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+	index := imageIndex{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("corrupt image index %s: %w", path, err)
+		}
+	}
+
+	if err := fn(&index); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, 0)
+	return err
+}
+
+// ListImages returns the images in the store, sorted by reference
+func ListImages() ([]Image, error) {
+	var images []Image
+	err := withImageIndex(func(index *imageIndex) error {
+		images = index.Images
+		return nil
+	})
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Reference() < images[j].Reference()
+	})
+	return images, err
+}
+
+// FindImage looks an image up by reference or by a prefix of its ID
+func FindImage(ref string) (Image, error) {
+	images, err := ListImages()
+	if err != nil {
+		return Image{}, err
+	}
+
+	if name, tag, err := ParseImageReference(ref); err == nil {
+		for _, img := range images {
+			if img.Name == name && img.Tag == tag {
+				return img, nil
+			}
+		}
+	}
+
+	// IDs have to be given with at least a few characters to be unambiguous
+	if len(ref) >= 4 {
+		for _, img := range images {
+			if strings.HasPrefix(img.ID, ref) {
+				return img, nil
+			}
+		}
+	}
+
+	return Image{}, fmt.Errorf("image '%s' not found", ref)
+}
+
+// AddImage copies a root filesystem directory into the store under the given reference
+func AddImage(ref, dir string) (Image, error) {
+	name, tag, err := ParseImageReference(ref)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if info, err := os.Stat(dir); err != nil {
+		return Image{}, err
+	} else if !info.IsDir() {
+		return Image{}, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	id, err := randomImageID()
+	if err != nil {
+		return Image{}, err
+	}
+
+	staging, err := newImageStaging()
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.RemoveAll(staging)
+
+	fmt.Printf("Copying %s into the image store..\n", dir)
+	rootfs := filepath.Join(staging, "rootfs")
+	if err := copy.Copy(dir, rootfs, copy.Options{PreserveOwner: true, PreserveTimes: true}); err != nil {
+		return Image{}, fmt.Errorf("failed to copy root filesystem: %w", err)
+	}
+
+	return registerImage(Image{ID: id, Name: name, Tag: tag, Created: time.Now()}, staging)
+}
+
+// newImageStaging creates a directory in the store to build an image in, so it can be moved in place atomically
+func newImageStaging() (string, error) {
+	if err := makeStoreDir(ImagesRoot); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(ImagesRoot, ".staging-")
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp creates it private, images are readable by everyone like ./root_fs
+	return dir, os.Chmod(dir, 0755)
+}
+
+// registerImage moves a staged image directory (holding rootfs/) into the store, unless the image
+// is stored already, and tags it. An image already holding the reference loses it.
+func registerImage(img Image, staging string) (Image, error) {
+	err := withImageIndex(func(index *imageIndex) error {
+		// Content addressed images may be in the store already
+		target := filepath.Join(ImagesRoot, img.ID)
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := os.Rename(staging, target); err != nil {
+				return fmt.Errorf("failed to store image: %w", err)
+			}
+		}
+
+		size, err := directorySize(imageRootfs(img.ID))
+		if err != nil {
+			return err
+		}
+		img.Size = size
+
+		var untagged []Image
+		images := index.Images[:0]
+		for _, existing := range index.Images {
+			if existing.Reference() == img.Reference() {
+				untagged = append(untagged, existing)
+				continue
+			}
+			images = append(images, existing)
+		}
+		index.Images = append(images, img)
+
+		for _, old := range untagged {
+			if old.ID == img.ID {
+				continue
+			}
+			// Keep an image containers still use around without a tag, like docker's dangling images
+			if imageUser(old.ID) != "" {
+				old.Tag = untaggedImageTag
+				index.Images = append(index.Images, old)
+				continue
+			}
+			removeUnreferencedImage(index, old.ID)
+		}
+		return nil
+	})
+
+	return img, err
+}
+
+// RemoveImage removes a reference from the store, and the image itself once nothing refers to it
+func RemoveImage(ref string) error {
+	img, err := FindImage(ref)
+	if err != nil {
+		return err
+	}
+
+	err = withImageIndex(func(index *imageIndex) error {
+		images := index.Images[:0]
+		shared := false
+		for _, existing := range index.Images {
+			if existing.Reference() == img.Reference() {
+				continue
+			}
+			shared = shared || existing.ID == img.ID
+			images = append(images, existing)
+		}
+
+		// Untagging is fine, but the overlays of its containers still use the image as their lower layer
+		if !shared {
+			if user := imageUser(img.ID); user != "" {
+				return fmt.Errorf("image '%s' is used by container '%s'", ref, user)
+			}
+		}
+
+		index.Images = images
+		removeUnreferencedImage(index, img.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed image %s (%s)\n", img.Reference(), img.ShortID())
+	return nil
+}
+
+// imageUser returns the name of a container created from the image, empty when there is none
+func imageUser(id string) string {
+	for _, list := range [][]Container{ContainersRunning, ContainersStarting, ContainerStopped} {
+		for _, c := range list {
+			if c.ImageID == id {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
+
+// removeUnreferencedImage deletes an image directory no reference points to anymore
+func removeUnreferencedImage(index *imageIndex, id string) {
+	for _, img := range index.Images {
+		if img.ID == id {
+			return
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(ImagesRoot, id)); err != nil {
+		fmt.Printf("Warning: could not remove image %s: %v\n", id, err)
+	}
+}
+
+// randomImageID returns an ID for images that have no content digest
+func randomImageID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// directorySize adds up the sizes of the regular files below dir
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
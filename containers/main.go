@@ -1,41 +1,194 @@
 package container
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
-	"syscall"
+	"runtime"
 	"time"
-
-	"golang.org/x/term"
 )
 
-// LaunchContainer creates and starts a new container with the specified binary
-func LaunchContainer(binaryPath string) {
-	fmt.Printf("Launching container with binary: %s\n", binaryPath)
+// LaunchContainer creates and starts a new container with the specified options
+func LaunchContainer(opts LaunchOptions) (Container, error) {
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	out := opts.Output
+	fmt.Fprintf(out, "Launching container with binary: %s\n", opts.BinaryPath)
+
+	// Without privileges a user namespace is the only way to get the other namespaces
+	if Rootless {
+		if opts.UserNS == nil {
+			opts.UserNS = rootlessUserNamespace()
+		} else if err := checkRootlessUserNamespace(opts.UserNS); err != nil {
+			return Container{}, err
+		}
+	}
+
+	if opts.UserNS != nil {
+		if err := validateUserNamespace(opts.UserNS); err != nil {
+			return Container{}, fmt.Errorf("invalid user namespace: %w", err)
+		}
+	}
+
+	capabilities, err := ResolveCapabilities(opts.CapAdd, opts.CapDrop)
+	if err != nil {
+		return Container{}, err
+	}
+
+	// Load the seccomp profile up front so a broken one fails before anything is created
+	if opts.Seccomp == "" {
+		opts.Seccomp = SeccompDefault
+	}
+	// Filters are only compiled for amd64 and arm64, the default profile is not worth refusing to run elsewhere
+	if opts.Seccomp == SeccompDefault && seccompArch == 0 {
+		fmt.Fprintf(out, "Warning: seccomp filtering is not supported on %s, the container runs unconfined\n", runtime.GOARCH)
+		opts.Seccomp = SeccompUnconfined
+	}
+	seccompProfile, err := LoadSeccompProfile(opts.Seccomp)
+	if err != nil {
+		return Container{}, err
+	}
+	if seccompProfile != nil {
+		seccompProfile = resolveSeccompProfile(seccompProfile, capabilities)
+		if _, err := compileSeccompProfile(seccompProfile); err != nil {
+			return Container{}, fmt.Errorf("invalid seccomp profile: %w", err)
+		}
+	}
+
+	logConfig, err := validateLogConfig(opts.Log)
+	if err != nil {
+		return Container{}, err
+	}
+
+	if err := validatePortMappings(opts.Ports); err != nil {
+		return Container{}, err
+	}
+	networkMode, err := resolveNetworkMode(opts)
+	if err != nil {
+		return Container{}, err
+	}
+
+	// A dynamically linked binary needs its loader and libraries, find them before anything is created
+	dependencies, err := binaryDependencies(opts.BinaryPath, containerBinaryPath)
+	if err != nil {
+		return Container{}, err
+	}
+
+	// A script needs its interpreter in the root filesystem
+	rootfsSource, image, err := resolveRootfsSource(opts.Image)
+	if err != nil {
+		return Container{}, err
+	}
+	rootfsName := "./root_fs"
+	if opts.Image != "" {
+		rootfsName = "image " + image.Reference()
+	}
+	interpreters, err := checkScriptInterpreters(opts.BinaryPath, rootfsSource, rootfsName, opts.CopyInterpreter, out)
+	if err != nil {
+		return Container{}, err
+	}
+	dependencies = append(dependencies, interpreters...)
+
+	process, err := newProcessSpec(opts, image.Config)
+	if err != nil {
+		return Container{}, err
+	}
 
 	// Prepare the container
-	newContainer := prepareNewContainerRootFs()
-	prepareTempNetworkFiles(newContainer)
+	newContainer, err := prepareNewContainerRootFs(opts)
+	if err != nil {
+		return Container{}, err
+	}
+	if err := copyBinaryDependencies(&newContainer, dependencies, out); err != nil {
+		os.RemoveAll(newContainer.Location)
+		return Container{}, err
+	}
+	newContainer.Process = process
+	newContainer.Resources = opts.Resources
+	newContainer.Capabilities = capabilities
+	newContainer.SeccompProfile = opts.Seccomp
+	newContainer.Ports = opts.Ports
+	newContainer.Log = logConfig
+	newContainer.TTY = opts.TTY
+	newContainer.Init = opts.Init
+
+	newContainer.NetworkMode = networkMode
+
+	if networkMode == NetworkBridge {
+		if err := setupBridgeNetwork(&newContainer, out); err != nil {
+			os.RemoveAll(newContainer.Location)
+			return Container{}, fmt.Errorf("failed to set up networking: %w", err)
+		}
+	}
+	prepareTempNetworkFiles(newContainer, out)
+
+	// The init process reads the resolved profile from the container directory
+	if seccompProfile != nil {
+		if err := writeSeccompProfile(newContainer, seccompProfile); err != nil {
+			teardownNetwork(newContainer)
+			os.RemoveAll(newContainer.Location)
+			return Container{}, err
+		}
+	}
+
+	// With -t it runs on a pseudo-terminal, handed over to its monitor
+	var console *console
+	if opts.TTY {
+		if console, err = openConsole(opts.UserNS, out); err != nil {
+			teardownNetwork(newContainer)
+			os.RemoveAll(newContainer.Location)
+			return Container{}, err
+		}
+	}
+
+	// Track it as starting, on disk as well so a crash mid-launch leaves a trace
+	ContainersStarting = append(ContainersStarting, newContainer)
+	if err := saveState(newContainer); err != nil {
+		fmt.Fprintf(out, "Warning: %v\n", err)
+	}
 
-	// Launch the namespaces with the binary
-	err := launchNamespaces(&newContainer, binaryPath)
+	// Launch the namespaces with the binary, its monitor records the exit once we let it
+	release, err := launchNamespaces(&newContainer, opts, console)
+	if console != nil {
+		console.Close()
+	}
+	ContainersStarting = removeContainerFromList(ContainersStarting, newContainer.Name)
 	if err != nil {
-		fmt.Printf("Error launching container: %v\n", err)
-		return
+		removeCgroup(newContainer.CgroupPath)
+		teardownNetwork(newContainer)
+		os.RemoveAll(newContainer.Location)
+		return Container{}, fmt.Errorf("error launching container: %w", err)
+	}
+
+	// Forward the published ports, a port that can't be bound fails the launch
+	if err := startPortProxy(&newContainer); err != nil {
+		release()
+		killAndWait(newContainer.NamespacePID, newContainer.StartTime, 5*time.Second)
+		waitForMonitor(newContainer)
+		removeCgroup(newContainer.CgroupPath)
+		teardownNetwork(newContainer)
+		os.RemoveAll(newContainer.Location)
+		return Container{}, err
 	}
 
 	// Move container from starting to running
+	newContainer.Status = StatusRunning
 	ContainersRunning = append(ContainersRunning, newContainer)
+	if err := saveState(newContainer); err != nil {
+		fmt.Fprintf(out, "Warning: %v\n", err)
+	}
+	release()
 
-	fmt.Printf("Container '%s' launched successfully (PID: %d)\n", newContainer.Name, newContainer.NamespacePID)
+	fmt.Fprintf(out, "Container '%s' launched successfully (PID: %d)\n", newContainer.Name, newContainer.NamespacePID)
+	return newContainer, nil
 }
 
-// ListContainers displays all running and starting containers
+// ListContainers displays all running, starting and stopped containers
 func ListContainers() {
 	fmt.Println("\n=== Containers ===")
 
-	if len(ContainersRunning) == 0 {
+	if len(ContainersRunning) == 0 && len(ContainersStarting) == 0 && len(ContainerStopped) == 0 {
 		fmt.Println("No containers found.")
 		return
 	}
@@ -44,146 +197,149 @@ func ListContainers() {
 		fmt.Println("\nRunning:")
 		for _, c := range ContainersRunning {
 			status := "running"
-			if !processExists(c.NamespacePID) {
+			if !containerAlive(c) {
 				status = "stopped"
 			}
-			fmt.Printf("  - %s (PID: %d, Status: %s)\n", c.Name, c.NamespacePID, status)
+			ports := ""
+			if len(c.Ports) > 0 {
+				ports = ", Ports: " + formatPorts(c.Ports)
+			}
+			fmt.Printf("  - %s (PID: %d, Status: %s%s)\n", c.Name, c.NamespacePID, status, ports)
 		}
 	}
 
-}
-
-// DeleteContainer stops and removes a container by name
-func DeleteContainer(name string) {
-	// Search in running containers
-	for i, c := range ContainersRunning {
-		if c.Name == name {
-			// Kill the process
-			if c.NamespacePID > 0 {
-				err := killAndWait(c.NamespacePID, 5*time.Second)
-				if err != nil {
-					fmt.Printf("Warning: %v\n", err)
-				}
-			}
-
-			// Remove the container directory
-			err := os.RemoveAll(c.Location)
-			if err != nil {
-				fmt.Printf("Error removing container directory: %v\n", err)
-			}
-
-			// Remove from list
-			ContainersRunning = append(ContainersRunning[:i], ContainersRunning[i+1:]...)
-			fmt.Printf("Container '%s' deleted successfully\n", name)
-			return
+	if len(ContainersStarting) > 0 {
+		fmt.Println("\nStarting:")
+		for _, c := range ContainersStarting {
+			fmt.Printf("  - %s (PID: %d)\n", c.Name, c.NamespacePID)
 		}
 	}
 
-	// Search in starting containers
-	for i, c := range ContainersStarting {
-		if c.Name == name {
-			// Kill the process
-			if c.NamespacePID > 0 {
-				err := killAndWait(c.NamespacePID, 5*time.Second)
-				if err != nil {
-					fmt.Printf("Warning: %v\n", err)
-				}
+	if len(ContainerStopped) > 0 {
+		fmt.Println("\nStopped:")
+		for _, c := range ContainerStopped {
+			if c.FinishedAt.IsZero() {
+				fmt.Printf("  - %s (created %s)\n", c.Name, c.CreatedAt.Format(time.RFC3339))
+				continue
 			}
-
-			// Remove the container directory
-			err := os.RemoveAll(c.Location)
-			if err != nil {
-				fmt.Printf("Error removing container directory: %v\n", err)
+			exit := fmt.Sprintf("exit code %d", c.ExitCode)
+			if c.ExitSignal != "" {
+				exit = "killed by " + c.ExitSignal
 			}
-
-			// Remove from list
-			ContainersStarting = append(ContainersStarting[:i], ContainersStarting[i+1:]...)
-			fmt.Printf("Container '%s' deleted successfully\n", name)
-			return
+			fmt.Printf("  - %s (created %s, %s at %s)\n", c.Name, c.CreatedAt.Format(time.RFC3339), exit, c.FinishedAt.Format(time.RFC3339))
 		}
 	}
-
-	fmt.Printf("Container '%s' not found\n", name)
 }
 
-// ShellIntoContainer opens a shell in the specified container's namespaces
-func ShellIntoContainer(name string) {
-	var targetContainer *Container
-
-	// Search in running containers
-	for i := range ContainersRunning {
-		if ContainersRunning[i].Name == name {
-			targetContainer = &ContainersRunning[i]
-			break
-		}
+// DeleteContainer stops and removes a container by name
+func DeleteContainer(name string) error {
+	c := findContainer(name)
+	if c == nil {
+		return fmt.Errorf("container '%s' not found", name)
 	}
+	target := *c
 
-	if targetContainer == nil {
-		fmt.Printf("Container '%s' not found\n", name)
-		return
+	// Kill the process, one that survives keeps the container as it is
+	if target.NamespacePID > 0 && containerAlive(target) {
+		if err := killAndWait(target.NamespacePID, target.StartTime, 5*time.Second); err != nil {
+			return fmt.Errorf("failed to stop container '%s': %w", name, err)
+		}
+		waitForMonitor(target)
 	}
 
-	if !processExists(targetContainer.NamespacePID) {
-		fmt.Printf("Container '%s' is not running (PID %d not found)\n", name, targetContainer.NamespacePID)
-		return
+	// Remove the container's cgroup
+	var errs []error
+	if err := removeCgroup(target.CgroupPath); err != nil {
+		errs = append(errs, err)
 	}
 
-	fmt.Printf("Entering container '%s' (PID: %d)...\n", name, targetContainer.NamespacePID)
+	// Stop forwarding its ports and give back its address
+	stopPortProxy(target)
+	teardownNetwork(target)
 
-	// Save terminal state before running the shell
-	fd := int(os.Stdin.Fd())
-	oldState, err := term.GetState(fd)
-	if err != nil {
-		fmt.Printf("Warning: could not get terminal state: %v\n", err)
+	// Remove the container directory. If that failed its state file is written again, so rm can be retried.
+	if err := os.RemoveAll(target.Location); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove container directory: %w", err))
+		if err := saveState(target); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		ContainersRunning = removeContainerFromList(ContainersRunning, name)
+		ContainersStarting = removeContainerFromList(ContainersStarting, name)
+		ContainerStopped = removeContainerFromList(ContainerStopped, name)
 	}
 
-	// Use nsenter to enter the container's namespaces
-	// -F (--fork) is needed when entering PID namespace to properly become PID 1's child
-	cmd := exec.Command("nsenter",
-		"-t", fmt.Sprintf("%d", targetContainer.NamespacePID),
-		"-m", "-u", "-n", "-C", "-p", "-F",
-		"-r", "-w", // Also change root and working directory
-		"/bin/sh")
-
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
-
-	// Always restore terminal state after the shell exits
-	if oldState != nil {
-		term.Restore(fd, oldState)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete container '%s': %w", name, errors.Join(errs...))
 	}
+	fmt.Printf("Container '%s' deleted successfully\n", name)
+	return nil
+}
 
-	// Also run stty sane to ensure terminal is fully reset
-	resetCmd := exec.Command("stty", "sane")
-	resetCmd.Stdin = os.Stdin
-	resetCmd.Run()
+// InspectContainer returns the details of a container by name
+func InspectContainer(name string) (Container, error) {
+	c := findContainer(name)
+	if c == nil {
+		return Container{}, fmt.Errorf("container '%s' not found", name)
+	}
 
-	// Print a newline to ensure clean output
-	fmt.Println()
+	details := *c
+	if containerAlive(details) {
+		caps, err := processCapabilities(details.NamespacePID)
+		if err != nil {
+			fmt.Printf("Warning: could not read capabilities of %s: %v\n", name, err)
+		}
+		details.EffectiveCapabilities = caps
+	}
+	return details, nil
+}
 
-	if err != nil {
-		// Check if it's an exit error (user exited the shell)
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				if status.ExitStatus() == 0 {
-					return
-				}
+// findContainer looks a container up by name in the running, starting and stopped lists
+func findContainer(name string) *Container {
+	for _, list := range [][]Container{ContainersRunning, ContainersStarting, ContainerStopped} {
+		for i := range list {
+			if list[i].Name == name {
+				return &list[i]
 			}
 		}
-		fmt.Printf("Error entering container: %v\n", err)
 	}
+	return nil
+}
+
+// removeContainerFromList returns the list without the named container
+func removeContainerFromList(list []Container, name string) []Container {
+	for i, c := range list {
+		if c.Name == name {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
 }
 
 // CleanupAllContainers stops and removes all containers
 func CleanupAllContainers() {
 	fmt.Println("Cleaning up all containers...")
-	cleanupContainers()
+	var names []string
+	for _, list := range [][]Container{ContainersRunning, ContainersStarting, ContainerStopped} {
+		for _, c := range list {
+			names = append(names, c.Name)
+		}
+	}
+	cleanupContainers(names)
+}
+
+// CleanupContainers stops and removes the named containers, leaving any other alone
+func CleanupContainers(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	fmt.Println("Cleaning up the containers launched from this menu...")
+	cleanupContainers(names)
 }
 
 // CreateContainer is kept for backwards compatibility
 func CreateContainer() {
-	LaunchContainer("/bin/sh")
+	if _, err := LaunchContainer(LaunchOptions{BinaryPath: "/bin/sh"}); err != nil {
+		fmt.Println(err)
+	}
 }
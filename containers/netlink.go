@@ -0,0 +1,315 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal rtnetlink client, just enough to set up bridges, veth pairs, addresses and routes
+// without depending on the ip(8) binary being installed on the host or in the container.
+
+// VETH_INFO_PEER from linux/veth.h
+const vethInfoPeer = 1
+
+type netlinkSocket struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink() (*netlinkSocket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	return &netlinkSocket{fd: fd}, nil
+}
+
+func (s *netlinkSocket) Close() {
+	unix.Close(s.fd)
+}
+
+// request sends one message and waits for the kernel's acknowledgement
+func (s *netlinkSocket) request(msgType uint16, flags uint16, payload []byte) error {
+	s.seq++
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(payload)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], s.seq)
+	msg = append(msg, payload...)
+
+	if err := unix.Sendto(s.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := unix.Recvfrom(s.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+
+		// Walk the messages in the datagram looking for the acknowledgement of our request
+		data := buf[:n]
+		for len(data) >= unix.SizeofNlMsghdr {
+			length := int(binary.NativeEndian.Uint32(data[0:4]))
+			if length < unix.SizeofNlMsghdr || length > len(data) {
+				return fmt.Errorf("malformed netlink message")
+			}
+			replyType := binary.NativeEndian.Uint16(data[4:6])
+			replySeq := binary.NativeEndian.Uint32(data[8:12])
+			body := data[unix.SizeofNlMsghdr:length]
+
+			if replySeq == s.seq && replyType == unix.NLMSG_ERROR {
+				if len(body) < 4 {
+					return fmt.Errorf("short netlink error message")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(body[0:4])); errno != 0 {
+					return unix.Errno(-errno)
+				}
+				return nil
+			}
+
+			next := (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+			if next > len(data) {
+				break
+			}
+			data = data[next:]
+		}
+	}
+}
+
+// netlinkAttr encodes a routing attribute, padded to 4 bytes
+func netlinkAttr(attrType uint16, data []byte) []byte {
+	length := unix.SizeofRtAttr + len(data)
+	attr := make([]byte, (length+3)&^3)
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:4], attrType)
+	copy(attr[unix.SizeofRtAttr:], data)
+	return attr
+}
+
+func netlinkString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func netlinkUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+// ifInfoMsg encodes a struct ifinfomsg
+func ifInfoMsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	msg[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(msg[8:12], flags)
+	binary.NativeEndian.PutUint32(msg[12:16], change)
+	return msg
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func linkIndex(name string) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("interface %s: %w", name, err)
+	}
+	return iface.Index, nil
+}
+
+// linkAddBridge creates a bridge device
+func linkAddBridge(name string) error {
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	payload := concat(
+		ifInfoMsg(0, 0, 0),
+		netlinkAttr(unix.IFLA_IFNAME, netlinkString(name)),
+		netlinkAttr(unix.IFLA_LINKINFO|unix.NLA_F_NESTED,
+			netlinkAttr(unix.IFLA_INFO_KIND, netlinkString("bridge"))),
+	)
+	if err := s.request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// linkAddVeth creates a veth pair
+func linkAddVeth(name, peer string) error {
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	peerInfo := concat(ifInfoMsg(0, 0, 0), netlinkAttr(unix.IFLA_IFNAME, netlinkString(peer)))
+	payload := concat(
+		ifInfoMsg(0, 0, 0),
+		netlinkAttr(unix.IFLA_IFNAME, netlinkString(name)),
+		netlinkAttr(unix.IFLA_LINKINFO|unix.NLA_F_NESTED, concat(
+			netlinkAttr(unix.IFLA_INFO_KIND, netlinkString("veth")),
+			netlinkAttr(unix.IFLA_INFO_DATA|unix.NLA_F_NESTED,
+				netlinkAttr(vethInfoPeer|unix.NLA_F_NESTED, peerInfo)),
+		)),
+	)
+	if err := s.request(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload); err != nil {
+		return fmt.Errorf("failed to create veth pair %s/%s: %w", name, peer, err)
+	}
+	return nil
+}
+
+// linkModify changes an existing link with the given attributes
+func linkModify(name string, flags, change uint32, attrs ...[]byte) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	payload := concat(append([][]byte{ifInfoMsg(index, flags, change)}, attrs...)...)
+	return s.request(unix.RTM_NEWLINK, 0, payload)
+}
+
+// linkSetUp brings a link up
+func linkSetUp(name string) error {
+	if err := linkModify(name, unix.IFF_UP, unix.IFF_UP); err != nil {
+		return fmt.Errorf("failed to bring %s up: %w", name, err)
+	}
+	return nil
+}
+
+// linkSetMaster attaches a link to a bridge
+func linkSetMaster(name, master string) error {
+	masterIndex, err := linkIndex(master)
+	if err != nil {
+		return err
+	}
+	if err := linkModify(name, 0, 0, netlinkAttr(unix.IFLA_MASTER, netlinkUint32(uint32(masterIndex)))); err != nil {
+		return fmt.Errorf("failed to attach %s to %s: %w", name, master, err)
+	}
+	return nil
+}
+
+// linkSetNsPid moves a link into the network namespace of a process
+func linkSetNsPid(name string, pid int) error {
+	if err := linkModify(name, 0, 0, netlinkAttr(unix.IFLA_NET_NS_PID, netlinkUint32(uint32(pid)))); err != nil {
+		return fmt.Errorf("failed to move %s to the namespace of %d: %w", name, pid, err)
+	}
+	return nil
+}
+
+// linkRename renames a link, it has to be down
+func linkRename(name, newName string) error {
+	if err := linkModify(name, 0, 0, netlinkAttr(unix.IFLA_IFNAME, netlinkString(newName))); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", name, newName, err)
+	}
+	return nil
+}
+
+// linkDelete removes a link, for a veth this removes the peer as well
+func linkDelete(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.request(unix.RTM_DELLINK, 0, ifInfoMsg(index, 0, 0)); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+// addrAdd assigns an IPv4 address to a link
+func addrAdd(name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("only IPv4 addresses are supported, got %s", addr)
+	}
+	prefixLen, _ := addr.Mask.Size()
+
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// struct ifaddrmsg
+	msg := make([]byte, unix.SizeofIfAddrmsg)
+	msg[0] = unix.AF_INET
+	msg[1] = uint8(prefixLen)
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+
+	payload := concat(msg,
+		netlinkAttr(unix.IFA_LOCAL, ip),
+		netlinkAttr(unix.IFA_ADDRESS, ip),
+	)
+	if err := s.request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload); err != nil {
+		return fmt.Errorf("failed to add %s to %s: %w", addr, name, err)
+	}
+	return nil
+}
+
+// routeAddDefault adds a default IPv4 route through the gateway
+func routeAddDefault(gateway net.IP, name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	s, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// struct rtmsg
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = unix.AF_INET
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = unix.RT_SCOPE_UNIVERSE
+	msg[7] = unix.RTN_UNICAST
+
+	payload := concat(msg,
+		netlinkAttr(unix.RTA_GATEWAY, gateway.To4()),
+		netlinkAttr(unix.RTA_OIF, netlinkUint32(uint32(index))),
+	)
+	if err := s.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, payload); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %w", gateway, err)
+	}
+	return nil
+}
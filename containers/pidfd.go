@@ -0,0 +1,125 @@
+package container
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// errProcessGone is returned for a process that exited, or whose PID now belongs to another process
+var errProcessGone = errors.New("process is gone")
+
+// processHandle refers to one particular process. With a pidfd (Linux 5.3+) signals and waits can't reach
+// another process that reused the PID. Older kernels fall back to comparing the start time in /proc/<pid>/stat.
+type processHandle struct {
+	pid       int
+	startTime uint64 // 0 when unknown, the PID is trusted then
+	pidfd     int    // -1 without pidfd support
+}
+
+// openProcess gets a handle on a process, checking its start time when known
+func openProcess(pid int, startTime uint64) (*processHandle, error) {
+	if pid <= 0 {
+		return nil, errProcessGone
+	}
+
+	p := &processHandle{pid: pid, startTime: startTime, pidfd: -1}
+	fd, err := unix.PidfdOpen(pid, 0)
+	switch {
+	case err == nil:
+		p.pidfd = fd
+	case errors.Is(err, unix.ESRCH):
+		return nil, errProcessGone
+	}
+
+	// Checked after opening the pidfd: from then on the PID can't be recycled under us
+	if !p.sameProcess() {
+		p.Close()
+		return nil, errProcessGone
+	}
+	return p, nil
+}
+
+// sameProcess reports whether the PID still belongs to the running process the handle was opened for,
+// an exited process waiting to be reaped doesn't count
+func (p *processHandle) sameProcess() bool {
+	state, startTime, err := processStat(p.pid)
+	if err != nil || state == 'Z' || state == 'X' {
+		return false
+	}
+	return p.startTime == 0 || startTime == p.startTime
+}
+
+// Close releases the pidfd
+func (p *processHandle) Close() {
+	if p.pidfd >= 0 {
+		unix.Close(p.pidfd)
+		p.pidfd = -1
+	}
+}
+
+// alive reports whether the process is still running. Unlike kill(pid, 0), a pidfd also sees
+// an exited process that has not been reaped yet as gone.
+func (p *processHandle) alive() bool {
+	if p.pidfd >= 0 {
+		return !p.wait(0)
+	}
+	return p.sameProcess()
+}
+
+// signal sends a signal to the process, ESRCH once it is gone
+func (p *processHandle) signal(sig syscall.Signal) error {
+	if p.pidfd >= 0 {
+		return unix.PidfdSendSignal(p.pidfd, sig, nil, 0)
+	}
+	if !p.sameProcess() {
+		return unix.ESRCH
+	}
+	return syscall.Kill(p.pid, sig)
+}
+
+// wait blocks until the process exits or the timeout expires, a negative timeout waits forever.
+// It reports whether the process exited.
+func (p *processHandle) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	// A pidfd polls readable once the process exits
+	if p.pidfd >= 0 {
+		for {
+			ms := -1
+			if timeout >= 0 {
+				ms = int(time.Until(deadline).Milliseconds())
+				if ms < 0 {
+					ms = 0
+				}
+			}
+			fds := []unix.PollFd{{Fd: int32(p.pidfd), Events: unix.POLLIN}}
+			n, err := unix.Poll(fds, ms)
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return err != nil || n > 0
+		}
+	}
+
+	// Without one all that is left is checking every 100ms
+	for p.sameProcess() {
+		if timeout >= 0 && !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// processAlive reports whether a process is running, a start time of 0 skips the PID reuse check
+func processAlive(pid int, startTime uint64) bool {
+	p, err := openProcess(pid, startTime)
+	if err != nil {
+		return false
+	}
+	defer p.Close()
+	return p.alive()
+}
@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package container
+
+// Seccomp filters are only compiled for amd64 and arm64. Elsewhere LaunchContainer falls back to
+// unconfined for the default profile, a profile given explicitly fails to compile.
+const seccompArch = 0
+
+const x32SyscallBit = 0
+
+var syscallNumbers = map[string]int{}
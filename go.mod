@@ -3,9 +3,12 @@ module malptainer
 go 1.25.5
 
 require (
-	github.com/otiai10/copy v1.14.1 // indirect
+	github.com/otiai10/copy v1.14.1
+	golang.org/x/sys v0.39.0
+	golang.org/x/term v0.38.0
+)
+
+require (
 	github.com/otiai10/mint v1.6.3 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
-	golang.org/x/term v0.38.0 // indirect
 )
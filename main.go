@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -16,12 +17,42 @@ func main() {
 		return
 	}
 
+	// Per-container process waiting for the init process and recording its exit
+	if len(os.Args) > 1 && os.Args[1] == "monitor" {
+		container.RunContainerMonitor()
+		return
+	}
+
+	// Helper running a command in a running container, see container.ExecContainer
+	if len(os.Args) > 1 && os.Args[1] == "exec-init" {
+		container.RunExecInit()
+		return
+	}
+
+	// Helper process forwarding a container's published ports
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		container.RunPortProxy(os.Args[2:])
+		return
+	}
+
+	// Pick up containers left behind by a previous run of the manager
+	container.LoadContainers()
+
+	// Non-interactive subcommands, the menu is only shown without one
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	fmt.Println("Container Manager")
 	fmt.Println("=================")
 
 	reader := bufio.NewReader(os.Stdin)
+	// Exiting the menu removes what it launched, containers of `malptainer run` are left alone
+	var launched []string
 
 	for {
+		// Pick up containers that exited, or were launched by another malptainer, in the meantime
+		container.LoadContainers()
 		printMenu()
 
 		fmt.Print("Enter choice: ")
@@ -37,7 +68,42 @@ func main() {
 			if binaryPath == "" {
 				binaryPath = "/bin/sh"
 			}
-			container.LaunchContainer(binaryPath)
+			fmt.Print("Enter image to use (default: ./root_fs): ")
+			image, _ := reader.ReadString('\n')
+			image = strings.TrimSpace(image)
+			// A shell needs a terminal, we stay attached to it until it exits or we detach
+			fmt.Print("Attach a terminal to the container? [y/N]: ")
+			answer, _ := reader.ReadString('\n')
+			attach := strings.EqualFold(strings.TrimSpace(answer), "y")
+			opts := container.LaunchOptions{BinaryPath: binaryPath, Image: image, TTY: attach}
+			c, err := container.LaunchContainer(opts)
+
+			// Offer to bring a script's missing interpreter along
+			var missing *container.MissingInterpreterError
+			if errors.As(err, &missing) && missing.OnHost {
+				fmt.Println(err)
+				fmt.Printf("Copy %s and its libraries from the host into the container? [y/N]: ", missing.Interpreter)
+				answer, _ := reader.ReadString('\n')
+				if strings.EqualFold(strings.TrimSpace(answer), "y") {
+					opts.CopyInterpreter = true
+					c, err = container.LaunchContainer(opts)
+				} else {
+					err = nil
+				}
+			}
+			if c.Name != "" {
+				launched = append(launched, c.Name)
+			}
+			if err == nil && opts.TTY && c.Name != "" {
+				keys, _ := container.ParseDetachKeys(container.DefaultDetachKeys)
+				var detached bool
+				if detached, err = container.AttachContainer(c.Name, container.AttachOptions{Input: true, DetachKeys: keys}); detached {
+					fmt.Printf("\nDetached from container '%s', it keeps running\n", c.Name)
+				}
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
 
 		case "2":
 			// List all containers
@@ -52,7 +118,9 @@ func main() {
 				fmt.Println("Container name is required")
 				continue
 			}
-			container.DeleteContainer(name)
+			if err := container.DeleteContainer(name); err != nil {
+				fmt.Println(err)
+			}
 
 		case "4":
 			// Shell into a container
@@ -63,11 +131,14 @@ func main() {
 				fmt.Println("Container name is required")
 				continue
 			}
-			container.ShellIntoContainer(name)
+			shell := container.ExecOptions{Args: []string{"/bin/sh"}, TTY: true, Interactive: true}
+			if _, err := container.ExecContainer(name, shell); err != nil {
+				fmt.Println(err)
+			}
 
 		case "5", "q", "Q", "exit":
 			fmt.Println("Exiting...")
-			container.CleanupAllContainers()
+			container.CleanupContainers(launched)
 			return
 
 		default:
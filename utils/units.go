@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseByteSize parses sizes like 512, 64k, 512M or 2G (binary units) into bytes
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	size := s
+
+	// Accept both "512M" and "512MB"
+	s = strings.TrimSuffix(strings.ToLower(s), "b")
+	if s == "" {
+		return 0, fmt.Errorf("invalid size")
+	}
+
+	multiplier := int64(1)
+	switch s[len(s)-1:] {
+	case "k":
+		multiplier = 1 << 10
+		s = s[:len(s)-1]
+	case "m":
+		multiplier = 1 << 20
+		s = s[:len(s)-1]
+	case "g":
+		multiplier = 1 << 30
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return value * multiplier, nil
+}
+
+// FormatByteSize renders a size in bytes with a binary unit, like 1.5MB
+func FormatByteSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
@@ -0,0 +1,30 @@
+package utils
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"4k", 4 << 10},
+		{"512M", 512 << 20},
+		{"512MB", 512 << 20},
+		{" 2g ", 2 << 30},
+		{"8589934591G", 8589934591 << 30},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "b", "M", "-1", "1.5G", "12X", "8589934592G", "9223372036854775807k"} {
+		if got, err := ParseByteSize(in); err == nil {
+			t.Errorf("%q was accepted as %d", in, got)
+		}
+	}
+}